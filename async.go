@@ -0,0 +1,114 @@
+package gouache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mgood/gouache/glue"
+)
+
+// continuation is a call to Continue that stopped before the end of the text,
+// with the output so far, so that the next call can pick up where it left off.
+type continuation struct {
+	start snapshot
+	b     strings.Builder
+	w     glue.RuneStringWriter
+	batch []varChange
+	steps int
+}
+
+// errOutOfTime pauses ContinueAsync once its time budget runs out.
+var errOutOfTime = errors.New("out of time")
+
+// ContinueAsync continues the story like Continue, but stops once the budget
+// of time runs out, so that a long section doesn't block the caller. It runs
+// at least one step each time. If the text isn't finished, done is false and
+// the next call to ContinueAsync or Continue resumes from where it stopped.
+// The text is only returned once done.
+func (s *Story) ContinueAsync(budget time.Duration) (text string, done bool, err error) {
+	deadline := time.Now().Add(budget)
+	text, err = s.continueUntil(func() error {
+		if time.Now().After(deadline) {
+			return errOutOfTime
+		}
+		return nil
+	})
+	if errors.Is(err, errOutOfTime) {
+		return "", false, nil
+	}
+	return text, err == nil, err
+}
+
+// ContinueContext continues the story like Continue, but stops with the
+// context's error if it's cancelled. The story is then rewound to where it was
+// before the call, or before the call to ContinueAsync that started the text.
+func (s *Story) ContinueContext(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		// a text that ContinueAsync started is rewound the same as if the
+		// context was cancelled part way through
+		if s.pending != nil {
+			s.restore(s.pending.start)
+			s.pending = nil
+		}
+		return "", err
+	}
+	return s.continueUntil(ctx.Err)
+}
+
+// continueUntil runs the story to the end of the text, unless pause returns
+// an error after a step. If the error is errOutOfTime, the continuation is kept
+// for the next call, otherwise the story is rewound to the start of the text.
+func (s *Story) continueUntil(pause func() error) (string, error) {
+	c := s.pending
+	if c == nil {
+		c = &continuation{start: s.snapshot()}
+		c.w = glue.NewWriter(&c.b)
+		s.tags = nil
+		s.warnings = nil
+	}
+	s.pending = nil
+	for s.CanContinue() {
+		before := s.globalVars()
+		el := s.elem
+		out, err := s.step()
+		if err != nil {
+			s.restore(c.start)
+			return "", err
+		}
+		c.steps++
+		text, tags := glue.SplitTags(out.String())
+		c.w.WriteString(text)
+		if err := s.checkLimits(el, c.steps, c.b.Len()); err != nil {
+			s.restore(c.start)
+			return "", err
+		}
+		s.tags = append(s.tags, tags...)
+		s.observe(before, &c.batch)
+		if !s.CanContinue() {
+			break
+		}
+		if err := pause(); err != nil {
+			if errors.Is(err, errOutOfTime) {
+				s.pending = c
+			} else {
+				s.restore(c.start)
+			}
+			return "", err
+		}
+	}
+	c.w.WriteEnd()
+	s.flushObservers(c.batch)
+	return c.b.String(), nil
+}
+
+// checkNotPending returns an error if a continuation hasn't finished, since
+// the activity would change the story out from under it.
+func (s *Story) checkNotPending(activity string) error {
+	if s.pending != nil {
+		return fmt.Errorf("can't %s in the middle of ContinueAsync, call ContinueAsync or Continue until it's done", activity)
+	}
+	return nil
+}
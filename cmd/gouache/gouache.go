@@ -7,7 +7,6 @@ import (
 	"os"
 
 	"github.com/mgood/gouache"
-	"github.com/mgood/gouache/glue"
 )
 
 func main() {
@@ -21,25 +20,35 @@ func main() {
 		log.Fatal(err)
 	}
 	b := bufio.NewWriter(os.Stdout)
-	w := glue.NewWriter(b)
-	elem, eval := gouache.Init(container, listDefs)
-	choices := gouache.Continue(w, eval, elem)
-	for len(choices) > 0 {
-		w.WriteEnd()
+	story, err := gouache.NewStory(container, listDefs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	continueStory(b, story)
+	for choices := story.CurrentChoices(); len(choices) > 0; choices = story.CurrentChoices() {
 		b.WriteRune('\n')
 		for i, choice := range choices {
-			w.WriteString(fmt.Sprintf("%d: %s\n", i+1, choice.Label))
+			fmt.Fprintf(b, "%d: %s\n", i+1, choice.Label)
 		}
-		w.WriteEnd()
 		b.WriteString("?> ")
 		b.Flush()
 		var i int
 		if _, err := fmt.Scanln(&i); err != nil {
 			log.Fatalf("unable to read input: %s", err)
 		}
-		choice := choices[i-1]
-		choices = gouache.Continue(w, choice.Eval, choice.Dest)
+		if err := story.ChooseChoiceIndex(i - 1); err != nil {
+			log.Fatal(err)
+		}
+		continueStory(b, story)
 	}
-	w.WriteEnd()
 	b.Flush()
 }
+
+func continueStory(b *bufio.Writer, story *gouache.Story) {
+	text, err := story.Continue()
+	b.WriteString(text)
+	if err != nil {
+		b.Flush()
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package gouache
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// In compatibility mode, numbers follow the reference runtime, where ints are
+// 32 bits and wrap around on overflow, and floats are single precision and
+// printed the way C# formats them.
+
+// compatValue wraps ints to the 32-bit range of the reference runtime, and
+// rounds floats to single precision.
+func compatValue(v Value) Value {
+	switch v := v.(type) {
+	case IntValue:
+		return IntValue(int32(v))
+	case FloatValue:
+		return FloatValue(float32(v))
+	}
+	return v
+}
+
+// compatOperands rounds the operands as the reference runtime stores them, and
+// formats the floats that an operator is about to convert to strings, since
+// the operators only know the default formatting.
+func compatOperands(a, b Value) (Value, Value) {
+	a, b = compatValue(a), compatValue(b)
+	_, sa := a.(StringValue)
+	_, sb := b.(StringValue)
+	if !sa && !sb {
+		return a, b
+	}
+	if f, ok := a.(FloatValue); ok {
+		a = StringValue(formatFloat32(f))
+	}
+	if f, ok := b.(FloatValue); ok {
+		b = StringValue(formatFloat32(f))
+	}
+	return a, b
+}
+
+// compatOutput is the text of a value, with floats printed as C# does.
+func compatOutput(v Value) Output {
+	if f, ok := v.(FloatValue); ok {
+		return Output(formatFloat32(f))
+	}
+	return outputOf(v)
+}
+
+// formatFloat32 formats a float like C#'s float.ToString(), which gives the
+// shortest digits that round trip, switching to an exponent such as "1E+10"
+// for numbers that need more than 9 digits before the decimal point, or more
+// than 4 zeros after it. Infinities are spelled out as in the invariant culture.
+func formatFloat32(f FloatValue) string {
+	switch {
+	case math.IsNaN(float64(f)):
+		return "NaN"
+	case math.IsInf(float64(f), 1):
+		return "Infinity"
+	case math.IsInf(float64(f), -1):
+		return "-Infinity"
+	}
+	s := strconv.FormatFloat(float64(f), 'e', -1, 32)
+	mantissa, exp, _ := strings.Cut(s, "e")
+	e, _ := strconv.Atoi(exp)
+	digits := len(strings.TrimPrefix(strings.Replace(mantissa, ".", "", 1), "-"))
+	// the position of the decimal point relative to the first digit
+	pos := e + 1
+	if f == 0 || (pos <= max(digits, 9) && pos >= -3) {
+		return strconv.FormatFloat(float64(f), 'f', -1, 32)
+	}
+	sign := "+"
+	if e < 0 {
+		sign = "-"
+		e = -e
+	}
+	return fmt.Sprintf("%sE%s%02d", mantissa, sign, e)
+}
+
+// output is the text of a value printed by the story.
+func (f *CallFrame) output(v Value) Output {
+	if f.compat {
+		return compatOutput(v)
+	}
+	return outputOf(v)
+}
+
+// outputOf is the text of a value, failing for values which can't be printed.
+func outputOf(v Value) Output {
+	o, ok := v.(Outputter)
+	if !ok {
+		panic(inkErrorf("cannot output a value of type %T", v))
+	}
+	return o.Output()
+}
@@ -0,0 +1,57 @@
+package gouache
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatFloat32(t *testing.T) {
+	// the expected strings are from float.ToString(CultureInfo.InvariantCulture)
+	// in .NET 8
+	cases := []struct {
+		value    float64
+		expected string
+	}{
+		{1e6, "1000000"},
+		{16777216, "16777216"},
+		{1e10, "1E+10"},
+		{1e-5, "1E-05"},
+		{1.0 / 3, "0.33333334"},
+		{1e8, "100000000"},
+		{123456789, "123456790"},
+		{1234567890, "1.234568E+09"},
+		{1e9, "1E+09"},
+		{0.0001, "0.0001"},
+		{0.001234, "0.001234"},
+		{1.5e38, "1.5E+38"},
+		{-2.5e-7, "-2.5E-07"},
+		{7.5, "7.5"},
+		{math.Copysign(0, -1), "-0"},
+		{math.MaxFloat32, "3.4028235E+38"},
+		{1e-40, "1E-40"},
+		{math.NaN(), "NaN"},
+		{math.Inf(1), "Infinity"},
+		{math.Inf(-1), "-Infinity"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expected, func(t *testing.T) {
+			assert.Equal(t, tc.expected, formatFloat32(FloatValue(tc.value)))
+		})
+	}
+}
+
+func TestSamplesCompatibility(t *testing.T) {
+	// the reference runtime gives the same output for these, which was checked
+	// by evaluating the expressions with 32-bit ints and floats in C#
+	for _, name := range []string{"math", "math-type-coercion"} {
+		t.Run(name, func(t *testing.T) {
+			base := "./testdata/" + name + ".ink"
+			container, listDefs := load(t, base+".json")
+			story := mustNewStory(t, container, listDefs)
+			story.SetCompatibility(true)
+			assert.Equal(t, readfile(t, base+".txt"), mustContinue(t, story))
+		})
+	}
+}
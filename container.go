@@ -107,23 +107,30 @@ func (c *Container) Find(name Address) (Element, []VisitAddr) {
 	// already `c` here. To make this lookup more consistent, just add a parent so
 	// that it comes back here for the right starting point.
 	c = &Container{Parent: c}
-	for i, p := range path {
+	for _, p := range path {
 		c = c.findContainer(p)
 		if c == nil {
-			panic(fmt.Errorf("container not found at %#v", path[:i+1]))
+			return nil, nil
 		}
 	}
 	return c.find(key)
 }
 
 func (c *Container) find(key string) (Element, []VisitAddr) {
+	var el *ContainerElement
+	var visits []VisitAddr
 	if index, err := strconv.Atoi(key); err == nil {
-		return c.atNoFlatten(index).Flatten()
+		if index < 0 || index >= len(c.Contents) {
+			return nil, nil
+		}
+		el, visits = c.atNoFlatten(index).Flatten()
+	} else if child := c.findContainer(key); child != nil {
+		el, visits = child.atNoFlatten(0).Flatten()
 	}
-	if child := c.findContainer(key); child != nil {
-		return child.atNoFlatten(0).Flatten()
+	if el == nil {
+		return nil, nil
 	}
-	return nil, nil
+	return *el, visits
 }
 
 func (c *Container) findContainer(key string) *Container {
@@ -131,7 +138,13 @@ func (c *Container) findContainer(key string) *Container {
 		return c.Parent
 	}
 	if index, err := strconv.Atoi(key); err == nil {
-		child := c.Contents[index].(Container)
+		if index < 0 || index >= len(c.Contents) {
+			return nil
+		}
+		child, ok := c.Contents[index].(Container)
+		if !ok {
+			return nil
+		}
 		child.Parent = c
 		child.ParentIndex = ptr(index)
 		return &child
@@ -151,6 +164,70 @@ func (c *Container) findContainer(key string) *Container {
 	return nil
 }
 
+// GlobalTags returns the tags at the very start of the story.
+func (c Container) GlobalTags() ([]string, error) {
+	el, _ := c.atNoFlatten(0).Flatten()
+	if el == nil {
+		return nil, nil
+	}
+	return leadingTags(*el)
+}
+
+// TagsAt returns the tags at the very start of the container at the address,
+// such as a knot or stitch, without running the story.
+func (c Container) TagsAt(addr Address) ([]string, error) {
+	el, _ := c.Find(addr)
+	if el == nil {
+		return nil, fmt.Errorf("container %q not found", addr)
+	}
+	return leadingTags(el.(ContainerElement))
+}
+
+// leadingTags collects the tags before any other content in the container.
+// Like the reference runtime, control commands such as "ev" are skipped. Only
+// plain text tags are supported, since dynamic tags need the story to be
+// running to evaluate them.
+func leadingTags(el ContainerElement) ([]string, error) {
+	var tags []string
+	inTag := false
+	for _, n := range el.Self.Contents[el.Index:] {
+		switch n := n.(type) {
+		case BeginTag:
+			inTag = true
+		case EndTag:
+			inTag = false
+		case Text:
+			if !inTag {
+				return tags, nil
+			}
+			tags = append(tags, strings.Join(strings.Fields(string(n)), " "))
+		default:
+			if isControlCommand(n) {
+				continue
+			}
+			if inTag {
+				return nil, fmt.Errorf("tag in %q contains non-text content %T", el.Self.Address(), n)
+			}
+			return tags, nil
+		}
+	}
+	return tags, nil
+}
+
+// isControlCommand reports whether the node is one of the reference runtime's
+// control commands, rather than content or a value.
+func isControlCommand(n Node) bool {
+	switch n.(type) {
+	case BeginEval, EndEval, Out, DupTop, Pop, FuncReturn, TunnelReturn,
+		BeginStringEval, EndStringEval, NoOp, ChoiceCounter, TurnCounter,
+		TurnsSince, ReadCountFunc, Random, SeedRandom, VisitIndex, Seq,
+		ThreadStart, Done, End, ListInt, ListRangeFunc, ListRandomFunc,
+		BeginTag, EndTag:
+		return true
+	}
+	return false
+}
+
 func (c *Container) Root() *Container {
 	for ; c.Parent != nil; c = c.Parent {
 	}
@@ -0,0 +1,99 @@
+package gouache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RuntimeError is an error from running the story, with the location of the
+// element that failed.
+type RuntimeError struct {
+	Address Address
+	Index   int
+	Node    Node
+	// CallStack lists the paths of the tunnel, function and thread calls that
+	// led to the error, with the innermost call first.
+	CallStack []Address
+	Err       error
+}
+
+func (e *RuntimeError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ink runtime error at %s (%T): %s", elementPath(e.Address, e.Index), e.Node, e.Err)
+	for _, addr := range e.CallStack {
+		fmt.Fprintf(&b, "\n\tcalled from %s", addr)
+	}
+	return b.String()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+func newRuntimeError(r any, el Element, eval Evaluator) *RuntimeError {
+	addr, index := el.Address()
+	e := &RuntimeError{
+		Address: addr,
+		Index:   index,
+		Node:    el.Node(),
+		Err:     recoveredError(r),
+	}
+	if se, ok := eval.(StepEvaluator); ok {
+		e.CallStack = se.Stack.CallStack()
+	}
+	return e
+}
+
+// Warning is a problem found while running the story which doesn't stop it,
+// with the location of the element where it was found.
+type Warning struct {
+	Address Address
+	Index   int
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("ink runtime warning at %s: %s", elementPath(w.Address, w.Index), w.Message)
+}
+
+func newWarning(el Element, msg string) Warning {
+	addr, index := el.Address()
+	return Warning{Address: addr, Index: index, Message: msg}
+}
+
+// inkError is the panic value for a problem with the story being run, such as
+// an operation on the wrong types or a missing divert target. The Story
+// recovers these to return them as errors. Any other panic is a bug in the
+// runtime, so it isn't recovered.
+type inkError struct {
+	err error
+}
+
+func inkErrorf(format string, a ...any) inkError {
+	return inkError{fmt.Errorf(format, a...)}
+}
+
+func (e inkError) Error() string {
+	return e.err.Error()
+}
+
+func (e inkError) Unwrap() error {
+	return e.err
+}
+
+// recoveredError returns the error from a value recovered from a panic,
+// panicking again unless it's an inkError.
+func recoveredError(r any) error {
+	if e, ok := r.(inkError); ok {
+		return e.err
+	}
+	panic(r)
+}
+
+// elementPath returns the path of the element at the index in the container.
+func elementPath(addr Address, index int) Address {
+	if addr == "" {
+		return Address(fmt.Sprint(index))
+	}
+	return Address(fmt.Sprintf("%s.%d", addr, index))
+}
@@ -0,0 +1,78 @@
+package gouache
+
+import "fmt"
+
+// ExternalFunction is a Go function bound to a function declared as EXTERNAL
+// in ink.
+type ExternalFunction struct {
+	// Func is called with the arguments from ink, and returns the result of the
+	// function, or nil if it doesn't return anything.
+	Func func(args []Value) (Value, error)
+	// Arity is the number of arguments the function expects.
+	Arity int
+	// LookaheadSafe marks functions without side effects, which can be called
+	// while the story looks ahead to check whether a line has ended. Otherwise
+	// the line ends before the function is called, so that it runs with the
+	// next line of content.
+	LookaheadSafe bool
+}
+
+func (fn ExternalFunction) call(stack *CallFrame, n ExternalCall) *CallFrame {
+	if n.Args != fn.Arity {
+		panic(inkErrorf("external function %q expects %d arguments, called with %d", n.Name, fn.Arity, n.Args))
+	}
+	args := make([]Value, n.Args)
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i], stack = stack.PopVal()
+	}
+	v, err := fn.Func(args)
+	if err != nil {
+		panic(inkErrorf("external function %q: %w", n.Name, err))
+	}
+	switch v.(type) {
+	case nil:
+		v = VoidValue{}
+	case IntValue, FloatValue, BoolValue, StringValue, ListValue, DivertTargetValue, VoidValue:
+	default:
+		panic(inkErrorf("external function %q returned unsupported type %T", n.Name, v))
+	}
+	return stack.PushVal(v)
+}
+
+// BindExternalFunction binds a Go function to a function declared as EXTERNAL
+// in ink. When no function is bound, ink calls a function with the same name
+// defined in the story, if there is one.
+func (s *Story) BindExternalFunction(name string, fn ExternalFunction) error {
+	if fn.Func == nil {
+		return fmt.Errorf("external function %q has no Func", name)
+	}
+	if _, ok := s.externals[name]; ok {
+		return fmt.Errorf("external function %q is already bound", name)
+	}
+	s.externals[name] = fn
+	return nil
+}
+
+// UnbindExternalFunction removes the Go function bound to an EXTERNAL
+// function.
+func (s *Story) UnbindExternalFunction(name string) error {
+	if _, ok := s.externals[name]; !ok {
+		return fmt.Errorf("external function %q is not bound", name)
+	}
+	delete(s.externals, name)
+	return nil
+}
+
+// atLookaheadUnsafe reports whether the next element calls an external
+// function which can't be called while looking ahead.
+func (s *Story) atLookaheadUnsafe() bool {
+	if s.elem == nil {
+		return false
+	}
+	n, ok := s.elem.Node().(ExternalCall)
+	if !ok {
+		return false
+	}
+	fn, ok := s.externals[n.Name]
+	return ok && !fn.LookaheadSafe
+}
@@ -0,0 +1,135 @@
+package gouache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// soundPlayer records the sounds played by the external story.
+type soundPlayer struct {
+	sounds []string
+}
+
+func (p *soundPlayer) bind(t *testing.T, story *Story, lookaheadSafe bool) {
+	t.Helper()
+	require.NoError(t, story.BindExternalFunction("play_sound", ExternalFunction{
+		Func: func(args []Value) (Value, error) {
+			p.sounds = append(p.sounds, string(args[0].(StringValue)))
+			return nil, nil
+		},
+		Arity:         1,
+		LookaheadSafe: lookaheadSafe,
+	}))
+}
+
+func TestExternalFunction(t *testing.T) {
+	container, listDefs := load(t, "./testdata/external.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	var player soundPlayer
+	player.bind(t, story, false)
+	require.NoError(t, story.BindExternalFunction("multiply", ExternalFunction{
+		Func: func(args []Value) (Value, error) {
+			return IntValue(10 * args[0].(IntValue) * args[1].(IntValue)), nil
+		},
+		Arity:         2,
+		LookaheadSafe: true,
+	}))
+	assert.Equal(t, "Sound check.\nThe door opens.\nTwo times three is 60.\n", mustContinue(t, story))
+	assert.Equal(t, []string{"door"}, player.sounds)
+}
+
+func TestExternalFunctionFallback(t *testing.T) {
+	container, listDefs := load(t, "./testdata/external.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	var player soundPlayer
+	player.bind(t, story, false)
+	assert.Equal(t, "Sound check.\nThe door opens.\nTwo times three is 6.\n", mustContinue(t, story))
+}
+
+func TestExternalFunctionNotBound(t *testing.T) {
+	container, listDefs := load(t, "./testdata/external.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	_, err := story.Continue()
+	var runtimeErr *RuntimeError
+	require.True(t, errors.As(err, &runtimeErr), "expected a RuntimeError, got %v", err)
+	assert.EqualError(t, runtimeErr.Err, `external function "play_sound" is not bound`)
+
+	var player soundPlayer
+	player.bind(t, story, false)
+	assert.Error(t, story.BindExternalFunction("play_sound", ExternalFunction{
+		Func:  func(args []Value) (Value, error) { return nil, nil },
+		Arity: 1,
+	}), "already bound")
+	require.NoError(t, story.UnbindExternalFunction("play_sound"))
+	assert.Error(t, story.UnbindExternalFunction("play_sound"))
+}
+
+func TestExternalFunctionArity(t *testing.T) {
+	container, listDefs := load(t, "./testdata/external.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	require.NoError(t, story.BindExternalFunction("play_sound", ExternalFunction{
+		Func:  func(args []Value) (Value, error) { return nil, nil },
+		Arity: 2,
+	}))
+	_, err := story.Continue()
+	var runtimeErr *RuntimeError
+	require.True(t, errors.As(err, &runtimeErr), "expected a RuntimeError, got %v", err)
+	assert.EqualError(t, runtimeErr.Err, `external function "play_sound" expects 2 arguments, called with 1`)
+}
+
+func TestExternalFunctionError(t *testing.T) {
+	container, listDefs := load(t, "./testdata/external.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	errNoSpeakers := errors.New("no speakers")
+	require.NoError(t, story.BindExternalFunction("play_sound", ExternalFunction{
+		Func:  func(args []Value) (Value, error) { return nil, errNoSpeakers },
+		Arity: 1,
+	}))
+	_, err := story.Continue()
+	assert.ErrorIs(t, err, errNoSpeakers)
+}
+
+func TestExternalFunctionLookahead(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		lookaheadSafe bool
+		sounds        []string
+		after         []string
+	}{
+		// the function is only called once the next line starts
+		{"unsafe", false, nil, []string{"door"}},
+		// as in the reference runtime, a safe function is called while looking
+		// ahead, and again once the story is rewound and reaches it for real
+		{"safe", true, []string{"door"}, []string{"door", "door"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			container, listDefs := load(t, "./testdata/external.ink.json")
+			story := mustNewStory(t, container, listDefs)
+			var player soundPlayer
+			player.bind(t, story, tc.lookaheadSafe)
+			assert.Equal(t, "Sound check.\n", mustContinueLine(t, story))
+			assert.Equal(t, tc.sounds, player.sounds)
+			assert.Equal(t, "The door opens.\n", mustContinueLine(t, story))
+			assert.Equal(t, tc.after, player.sounds)
+		})
+	}
+}
+
+func TestExternalFunctionPanic(t *testing.T) {
+	container, listDefs := load(t, "./testdata/external.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	// a panic that isn't from the story is a bug, so it isn't turned into a
+	// RuntimeError
+	require.NoError(t, story.BindExternalFunction("play_sound", ExternalFunction{
+		Func: func(args []Value) (Value, error) {
+			var m map[string]int
+			m["crash"]++
+			return nil, nil
+		},
+		Arity: 1,
+	}))
+	assert.PanicsWithError(t, "assignment to entry in nil map", func() { story.Continue() })
+}
@@ -0,0 +1,83 @@
+package gouache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultFlowName is the name of the flow that a story starts in.
+const DefaultFlowName = "DEFAULT_FLOW"
+
+// CurrentFlowName returns the name of the flow the story is running.
+func (s *Story) CurrentFlowName() string {
+	return s.flowName
+}
+
+// SwitchFlow switches to the named flow, creating it at the start of the story
+// if it doesn't exist yet. Each flow has its own position in the story, output
+// and choices, but the variables, visit counts and turns are shared by every
+// flow.
+func (s *Story) SwitchFlow(name string) error {
+	if err := s.checkNotPending("switch flow"); err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("flow name is empty")
+	}
+	if name == s.flowName {
+		return nil
+	}
+	state := s.eval.(StepEvaluator).Stack.storyState
+	if s.flows == nil {
+		s.flows = make(map[string]snapshot)
+	}
+	s.flows[s.flowName] = s.snapshot()
+	flow, ok := s.flows[name]
+	if ok {
+		delete(s.flows, name)
+		se := flow.eval.(StepEvaluator)
+		se.Stack = se.Stack.withStoryState(state)
+		flow.eval = se
+	} else {
+		flow = s.startFlow(state)
+	}
+	s.restore(flow)
+	s.flowName = name
+	return nil
+}
+
+// startFlow returns a new flow at the start of the root container.
+func (s *Story) startFlow(state storyState) snapshot {
+	elem, visitAddrs := s.root.atNoFlatten(0).Flatten()
+	stack := (&CallFrame{}).withStoryState(state)
+	stack = visit("", visitAddrs, stack)
+	flow := snapshot{
+		eval: StepEvaluator{Stack: stack, Stepper: BaseEvaluator{}},
+	}
+	if elem != nil {
+		// an empty root container leaves the flow with nothing to continue
+		flow.elem = elem
+	}
+	return flow
+}
+
+// RemoveFlow discards the named flow. Removing the current flow switches back
+// to the default flow, which can't be removed.
+func (s *Story) RemoveFlow(name string) error {
+	if err := s.checkNotPending("remove a flow"); err != nil {
+		return err
+	}
+	if name == DefaultFlowName {
+		return errors.New("cannot remove the default flow")
+	}
+	if name == s.flowName {
+		if err := s.SwitchFlow(DefaultFlowName); err != nil {
+			return err
+		}
+	}
+	if _, ok := s.flows[name]; !ok {
+		return fmt.Errorf("flow %q not found", name)
+	}
+	delete(s.flows, name)
+	return nil
+}
@@ -0,0 +1,82 @@
+package gouache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func choiceLabels(story *Story) []string {
+	var labels []string
+	for _, choice := range story.CurrentChoices() {
+		labels = append(labels, choice.Label)
+	}
+	return labels
+}
+
+func TestSwitchFlow(t *testing.T) {
+	container, listDefs := load(t, "./testdata/flows.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, DefaultFlowName, story.CurrentFlowName())
+	assert.Equal(t, "Main story.\n", mustContinue(t, story))
+
+	require.NoError(t, story.SwitchFlow("npc"))
+	assert.Equal(t, "npc", story.CurrentFlowName())
+	// a new flow starts at the beginning of the story
+	assert.True(t, story.CanContinue())
+	assert.Empty(t, story.CurrentChoices())
+	require.NoError(t, story.ChoosePath("chatter"))
+	assert.Equal(t, "Side chatter, coins: 10.\n", mustContinue(t, story))
+	assert.Equal(t, []string{"Listen"}, choiceLabels(story))
+
+	// the variables are shared, but each flow keeps its own choices
+	require.NoError(t, story.SwitchFlow(DefaultFlowName))
+	assert.False(t, story.CanContinue())
+	assert.Equal(t, []string{"Pay"}, choiceLabels(story))
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Paid, coins: 11.\n", mustContinue(t, story))
+
+	require.NoError(t, story.SwitchFlow("npc"))
+	assert.Equal(t, []string{"Listen"}, choiceLabels(story))
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Listened.\n", mustContinue(t, story))
+
+	coins, err := story.Variables().GetInt("coins")
+	require.NoError(t, err)
+	assert.Equal(t, 11, coins)
+}
+
+func TestSwitchFlowState(t *testing.T) {
+	container, listDefs := load(t, "./testdata/flows.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Main story.\n", mustContinue(t, story))
+	require.NoError(t, story.SwitchFlow("npc"))
+	require.NoError(t, story.ChoosePath("chatter"))
+	assert.Equal(t, "Side chatter, coins: 10.\n", mustContinue(t, story))
+
+	story = reload(t, story, container, listDefs)
+	assert.Equal(t, "npc", story.CurrentFlowName())
+	assert.Equal(t, []string{"Listen"}, choiceLabels(story))
+
+	require.NoError(t, story.SwitchFlow(DefaultFlowName))
+	assert.Equal(t, []string{"Pay"}, choiceLabels(story))
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Paid, coins: 11.\n", mustContinue(t, story))
+}
+
+func TestRemoveFlow(t *testing.T) {
+	container, listDefs := load(t, "./testdata/flows.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Main story.\n", mustContinue(t, story))
+	require.NoError(t, story.SwitchFlow("npc"))
+
+	// removing the current flow switches back to the default flow
+	require.NoError(t, story.RemoveFlow("npc"))
+	assert.Equal(t, DefaultFlowName, story.CurrentFlowName())
+	assert.Equal(t, []string{"Pay"}, choiceLabels(story))
+
+	assert.EqualError(t, story.RemoveFlow("npc"), `flow "npc" not found`)
+	assert.EqualError(t, story.RemoveFlow(DefaultFlowName), "cannot remove the default flow")
+	assert.EqualError(t, story.SwitchFlow(""), "flow name is empty")
+}
@@ -0,0 +1,109 @@
+package gouache
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mgood/gouache/glue"
+)
+
+// hostReturn is where a function called by the host returns to. Its next
+// element is itself, so the story stops there once the function returns.
+type hostReturn struct{}
+
+func (r hostReturn) Node() Node {
+	return NoOp{}
+}
+
+func (r hostReturn) Address() (Address, int) {
+	return "", 0
+}
+
+func (r hostReturn) Find(addr Address) (Element, []VisitAddr) {
+	return nil, nil
+}
+
+func (r hostReturn) Next() (Element, []VisitAddr) {
+	return r, nil
+}
+
+// EvaluateFunction runs an ink function to completion, passing the arguments
+// converted as for Variables.Set, and returns its result and the text it
+// output. The result is nil if the function doesn't return a value.
+//
+// As in the reference runtime, the function is a knot named at the top level
+// of the story. The position in the story, the eval stack and the choices are
+// left as they were, but changes the function makes to variables and visit
+// counts are kept. Warnings returns the warnings from the function.
+func (s *Story) EvaluateFunction(name string, args ...any) (Value, string, error) {
+	if err := s.checkNotPending("evaluate a function"); err != nil {
+		return nil, "", err
+	}
+	if _, ok := s.root.Nested[name]; !ok || name == "global decl" {
+		return nil, "", fmt.Errorf("function %q not found", name)
+	}
+	dest, visitAddrs := s.root.Find(Address(name))
+	if dest == nil {
+		return nil, "", fmt.Errorf("function %q not found", name)
+	}
+	start := s.snapshot()
+	s.warnings = nil
+	orig := start.eval.(StepEvaluator)
+	stack := orig.Stack
+	for i, arg := range args {
+		v, err := toValue(arg)
+		if err != nil {
+			return nil, "", fmt.Errorf("argument %d: %w", i, err)
+		}
+		stack = stack.PushVal(v)
+	}
+	stack = stack.PushFrame(hostReturn{}, EvalEvaluator{Prev: BaseEvaluator{}}, true)
+	stack = visit("", visitAddrs, stack)
+	s.elem = dest
+	s.eval = StepEvaluator{Stack: stack, Stepper: BaseEvaluator{}}
+	s.choices = nil
+
+	var b strings.Builder
+	w := glue.NewWriter(&b)
+	w.WriteString(string(glue.FuncStart))
+	var batch []varChange
+	for steps := 1; ; steps++ {
+		if _, ok := s.elem.(hostReturn); ok {
+			break
+		}
+		if !s.CanContinue() {
+			s.restore(start)
+			return nil, "", fmt.Errorf("function %q ended without returning", name)
+		}
+		before := s.globalVars()
+		el := s.elem
+		out, err := s.step()
+		if err != nil {
+			s.restore(start)
+			return nil, "", err
+		}
+		text, _ := glue.SplitTags(out.String())
+		w.WriteString(text)
+		if err := s.checkLimits(el, steps, b.Len()); err != nil {
+			s.restore(start)
+			return nil, "", err
+		}
+		s.observe(before, &batch)
+	}
+	w.WriteEnd()
+
+	after := s.eval.(StepEvaluator).Stack
+	if after.evalStack.Len() <= orig.Stack.evalStack.Len() {
+		s.restore(start)
+		return nil, "", fmt.Errorf("function %q didn't leave a result on the eval stack", name)
+	}
+	result, _ := after.PopVal()
+	if _, ok := result.(VoidValue); ok {
+		result = nil
+	}
+	restored := orig.Stack.withShared(after).withEvalStack(orig.Stack.evalStack)
+	s.restore(start)
+	s.eval = StepEvaluator{Stack: restored, Stepper: orig.Stepper}
+	s.flushObservers(batch)
+	return result, b.String(), nil
+}
@@ -0,0 +1,114 @@
+package gouache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateFunction(t *testing.T) {
+	container, listDefs := load(t, "./testdata/func-abs.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	result, text, err := story.EvaluateFunction("abs", -3)
+	require.NoError(t, err)
+	assert.Equal(t, IntValue(3), result)
+	assert.Equal(t, "", text)
+	// the story still starts from the beginning
+	assert.Equal(t, "abs(-18) = 18\n", mustContinue(t, story))
+}
+
+func TestEvaluateFunctionText(t *testing.T) {
+	container, listDefs := load(t, "./testdata/func-text-content.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	result, text, err := story.EvaluateFunction("surround_foo_bar", "hello")
+	require.NoError(t, err)
+	assert.Nil(t, result)
+	assert.Equal(t, "foo\nhello\nbar\n", text)
+
+	result, text, err = story.EvaluateFunction("void_return")
+	require.NoError(t, err)
+	assert.Nil(t, result)
+	assert.Equal(t, "should have \"void\" return\n", text)
+}
+
+func TestEvaluateFunctionKeepsState(t *testing.T) {
+	container, listDefs := load(t, "./testdata/quest.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	changes := recordChanges(t, story, "gold")
+	assert.Equal(t, "Welcome.\n", mustContinue(t, story))
+	before := story.eval.(StepEvaluator)
+
+	result, text, err := story.EvaluateFunction("describe_quest", "dragon")
+	require.NoError(t, err)
+	assert.Equal(t, IntValue(2), result)
+	assert.Equal(t, "Quest dragon: gold 1.\n", text)
+
+	// the changes to the globals are kept, but not the position in the story
+	assert.Equal(t, []string{"gold: 0 -> 1"}, *changes)
+	gold, err := story.Variables().GetInt("gold")
+	require.NoError(t, err)
+	assert.Equal(t, 1, gold)
+	after := story.eval.(StepEvaluator)
+	assert.Equal(t, before.Stepper, after.Stepper)
+	assert.Equal(t, before.Stack.evalStack, after.Stack.evalStack)
+	assert.Equal(t, before.Stack.prev, after.Stack.prev)
+	assert.False(t, story.CanContinue())
+	require.Len(t, story.CurrentChoices(), 2)
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Bought.\n", mustContinue(t, story))
+}
+
+func TestEvaluateFunctionError(t *testing.T) {
+	container, listDefs := load(t, "./testdata/quest.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	// the function expects an argument
+	_, _, err := story.EvaluateFunction("describe_quest")
+	var runtimeErr *RuntimeError
+	require.True(t, errors.As(err, &runtimeErr), "expected a RuntimeError, got %v", err)
+	assert.Equal(t, "Welcome.\n", mustContinue(t, story))
+}
+
+func TestEvaluateFunctionNotFound(t *testing.T) {
+	container, listDefs := load(t, "./testdata/func-abs.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	_, _, err := story.EvaluateFunction("missing")
+	assert.EqualError(t, err, `function "missing" not found`)
+}
+
+func TestEvaluateFunctionInvalid(t *testing.T) {
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [["done", null], "done", {
+			"nothing": ["~ret", null],
+			"warn": ["ev", 1, "/ev", {"VAR=": "score", "re": true}, "ev", 2, "/ev", "~ret", null],
+			"quiet": ["ev", 3, "/ev", "~ret", {"stitch": ["ev", 4, "/ev", "~ret", null]}]
+		}],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+
+	// a function which returns without a value is an error rather than a panic
+	_, _, err = story.EvaluateFunction("nothing")
+	assert.EqualError(t, err, `function "nothing" didn't leave a result on the eval stack`)
+
+	// only knots can be called, not other paths into the story
+	for _, name := range []string{"0", "quiet.stitch", "global decl"} {
+		_, _, err = story.EvaluateFunction(name)
+		assert.EqualError(t, err, fmt.Sprintf("function %q not found", name))
+	}
+
+	// the warnings are from the latest call
+	result, _, err := story.EvaluateFunction("warn")
+	require.NoError(t, err)
+	assert.Equal(t, IntValue(2), result)
+	assert.Len(t, story.Warnings(), 1)
+	result, _, err = story.EvaluateFunction("quiet")
+	require.NoError(t, err)
+	assert.Equal(t, IntValue(3), result)
+	assert.Empty(t, story.Warnings())
+}
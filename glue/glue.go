@@ -16,13 +16,27 @@ type RuneStringWriter interface {
 	WriteEnd() (n int, err error)
 }
 
+// NewlineHolder is implemented by writers that hold back a newline until they
+// know whether glue removes it.
+type NewlineHolder interface {
+	PendingNewline() bool
+}
+
+// PendingNewline reports whether w is holding back a newline. Writers which
+// don't implement NewlineHolder never hold one back.
+func PendingNewline(w RuneStringWriter) bool {
+	h, ok := w.(NewlineHolder)
+	return ok && h.PendingNewline()
+}
+
 type writer struct {
 	RuneWriter
 	state stateFn
+	inTag bool
 }
 
 func NewWriter(b RuneWriter) RuneStringWriter {
-	return &writer{b, stateBeginText}
+	return &writer{RuneWriter: b, state: stateBeginText}
 }
 
 func (w *writer) WriteEnd() (n int, err error) {
@@ -34,10 +48,55 @@ func (w *writer) WriteString(s string) (n int, err error) {
 }
 
 func (w *writer) WriteRune(r rune) (n int, err error) {
+	// tags are not part of the text, so skip them without changing the state
+	switch {
+	case r == TagStart:
+		w.inTag = true
+		return 0, nil
+	case r == TagEnd:
+		w.inTag = false
+		return 0, nil
+	case w.inTag:
+		return 0, nil
+	}
 	w.state, n, err = w.state(w.RuneWriter, r)
 	return
 }
 
+// PendingNewline reports whether the text written so far ends with a newline
+// that has not been written yet. The newline is held back until more text
+// follows, since glue may still remove it.
+func (w *writer) PendingNewline() bool {
+	// probe the next state without updating the writer, to see whether more
+	// text would be preceded by the newline
+	var p probe
+	w.state(&p, '.')
+	return len(p) > 0 && p[0] == '\n'
+}
+
+type probe []rune
+
+func (p *probe) WriteRune(r rune) (int, error) {
+	*p = append(*p, r)
+	return 1, nil
+}
+
+// SplitTags separates the text from the tags delimited by TagStart and TagEnd.
+func SplitTags(s string) (string, []string) {
+	var tags []string
+	var b strings.Builder
+	for {
+		before, rest, found := strings.Cut(s, string(TagStart))
+		b.WriteString(before)
+		if !found {
+			return b.String(), tags
+		}
+		tag, after, _ := strings.Cut(rest, string(TagEnd))
+		tags = append(tags, tag)
+		s = after
+	}
+}
+
 func StripInline(s string) string {
 	var b strings.Builder
 	w := NewWriter(&b)
@@ -61,6 +120,11 @@ const (
 	FuncStart = '\u000e'
 	FuncEnd   = '\u000f'
 
+	// Use "Start of Text" and "End of Text" to delimit tags in the output. The
+	// tags are not part of the text, so the writer skips them.
+	TagStart = '\u0002'
+	TagEnd   = '\u0003'
+
 	// Use NUL byte to mark the end of a stream of text. This is used by
 	// WriteEnd to put a '\n' if needed after a block of text. This mainly
 	// resets the state before presenting something like a choice that would
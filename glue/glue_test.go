@@ -109,3 +109,43 @@ func TestImplicitInlineGlue(t *testing.T) {
 	w.WriteEnd()
 	assert.Equal(t, "before\nafter\n", b.String())
 }
+
+func TestPendingNewline(t *testing.T) {
+	var b strings.Builder
+	w := glue.NewWriter(&b)
+	assert.False(t, glue.PendingNewline(w))
+	w.WriteString("one")
+	assert.False(t, glue.PendingNewline(w))
+	w.WriteString("\n")
+	assert.True(t, glue.PendingNewline(w))
+	w.WriteString(" ")
+	assert.True(t, glue.PendingNewline(w))
+	w.WriteRune(glue.Glue)
+	assert.False(t, glue.PendingNewline(w))
+	w.WriteString("two\n")
+	assert.True(t, glue.PendingNewline(w))
+	w.WriteString("three")
+	assert.False(t, glue.PendingNewline(w))
+	w.WriteEnd()
+	assert.Equal(t, "onetwo\nthree\n", b.String())
+}
+
+func TestSkipTags(t *testing.T) {
+	var b strings.Builder
+	w := glue.NewWriter(&b)
+	w.WriteString("one ")
+	w.WriteString(string(glue.TagStart) + "a tag\n" + string(glue.TagEnd))
+	w.WriteString("\ntwo")
+	w.WriteEnd()
+	assert.Equal(t, "one\ntwo\n", b.String())
+}
+
+func TestSplitTags(t *testing.T) {
+	text, tags := glue.SplitTags("one" + string(glue.TagStart) + "a" + string(glue.TagEnd) + " two" + string(glue.TagStart) + "b" + string(glue.TagEnd))
+	assert.Equal(t, "one two", text)
+	assert.Equal(t, []string{"a", "b"}, tags)
+
+	text, tags = glue.SplitTags("no tags")
+	assert.Equal(t, "no tags", text)
+	assert.Nil(t, tags)
+}
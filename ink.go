@@ -2,12 +2,10 @@ package gouache
 
 import (
 	"cmp"
+	"errors"
 	"fmt"
-	"hash/fnv"
-	"io"
 	"maps"
 	"math"
-	"math/rand/v2"
 	"slices"
 	"strings"
 )
@@ -79,6 +77,13 @@ type FuncCall struct {
 	Var  bool    `json:"var"`
 }
 
+// ExternalCall calls a function declared as EXTERNAL in ink, which is bound
+// to a Go function by the host.
+type ExternalCall struct {
+	Name string `json:"x()"`
+	Args int    `json:"exArgs"`
+}
+
 type TunnelCall struct {
 	Dest Address `json:"->t->"`
 	Var  bool    `json:"var"`
@@ -112,71 +117,216 @@ type ListAllFunc struct{}       // "LIST_ALL"
 type ListInvertFunc struct{}    // "LIST_INVERT"
 type ListIntersectFunc struct{} // "L^"
 type ListRangeFunc struct{}     // "range"
+type ListRandomFunc struct{}    // "lrnd"
 type Seq struct{}               // "seq"
+type Random struct{}            // "rnd"
+type SeedRandom struct{}        // "srnd"
 
 type UnaryOp func(a Value) Value
 
-var Not UnaryOp = func(a Value) Value {
-	return boolean(!truthy(a))
-}
+// unaryOp implements a UnaryOp for each type of value it supports. Bools are
+// promoted to ints before the operator is applied.
+type unaryOp struct {
+	name  string
+	int   func(a IntValue) Value
+	float func(a FloatValue) Value
+	list  func(a ListValue) Value
+}
+
+func (op unaryOp) call(a Value) Value {
+	t := max(typeOf(a), intType)
+	a = coerce(a, t)
+	switch t {
+	case intType:
+		if op.int != nil {
+			return op.int(a.(IntValue))
+		}
+	case floatType:
+		if op.float != nil {
+			return op.float(a.(FloatValue))
+		}
+	case listType:
+		if op.list != nil {
+			return op.list(a.(ListValue))
+		}
+	}
+	panic(inkErrorf("cannot perform operation '%s' on %s", op.name, t))
+}
+
+var Not UnaryOp = unaryOp{
+	name:  "!",
+	int:   func(a IntValue) Value { return boolean(a == 0) },
+	float: func(a FloatValue) Value { return boolean(a == 0) },
+	list: func(a ListValue) Value {
+		// the reference runtime gives an int rather than a bool for lists
+		return boolInt(boolean(len(a.Items) == 0))
+	},
+}.call
+
+var Neg UnaryOp = unaryOp{
+	name:  "_",
+	int:   func(a IntValue) Value { return -a },
+	float: func(a FloatValue) Value { return -a },
+}.call
+
+var Floor UnaryOp = unaryOp{
+	name:  "FLOOR",
+	int:   func(a IntValue) Value { return a },
+	float: func(a FloatValue) Value { return FloatValue(math.Floor(float64(a))) },
+}.call
+
+var Ceiling UnaryOp = unaryOp{
+	name:  "CEILING",
+	int:   func(a IntValue) Value { return a },
+	float: func(a FloatValue) Value { return FloatValue(math.Ceil(float64(a))) },
+}.call
+
+var Int UnaryOp = unaryOp{
+	name:  "INT",
+	int:   func(a IntValue) Value { return a },
+	float: func(a FloatValue) Value { return IntValue(a) },
+}.call
+
+var Float UnaryOp = unaryOp{
+	name:  "FLOAT",
+	int:   func(a IntValue) Value { return FloatValue(a) },
+	float: func(a FloatValue) Value { return a },
+}.call
 
-var Neg UnaryOp = func(a Value) Value {
-	switch a := a.(type) {
-	case IntValue:
-		return -a
-	case FloatValue:
-		return -a
-	case BoolValue:
-		return -boolInt(a)
-	default:
-		panic(fmt.Errorf("unsupported type %T", a))
+type BinOp func(a, b Value) Value
+
+// binaryOp implements a BinOp for each type of value it supports. Both values
+// are promoted to the same type before the operator is applied, except for
+// lists, which can only be combined with other lists, or with ints when
+// listInt is set.
+type binaryOp struct {
+	name    string
+	int     func(a, b IntValue) Value
+	float   func(a, b FloatValue) Value
+	str     func(a, b StringValue) Value
+	list    func(a, b ListValue) Value
+	divert  func(a, b DivertTargetValue) Value
+	listInt func(a ListValue, b IntValue) Value
+	// logical operators compare the truthiness of a list and another type
+	logical bool
+}
+
+func (op binaryOp) call(a, b Value) Value {
+	ta, tb := typeOf(a), typeOf(b)
+	if ta == listType || tb == listType {
+		return op.callList(a, b, ta, tb)
+	}
+	t := max(ta, tb, intType)
+	a, b = coerce(a, t), coerce(b, t)
+	switch t {
+	case intType:
+		if op.int != nil {
+			return op.int(a.(IntValue), b.(IntValue))
+		}
+	case floatType:
+		if op.float != nil {
+			return op.float(a.(FloatValue), b.(FloatValue))
+		}
+	case stringType:
+		if op.str != nil {
+			return op.str(a.(StringValue), b.(StringValue))
+		}
+	case divertType:
+		if op.divert != nil {
+			return op.divert(a.(DivertTargetValue), b.(DivertTargetValue))
+		}
 	}
+	panic(inkErrorf("cannot perform operation '%s' on %s", op.name, t))
 }
 
-func floatOp(op func(float64) float64) UnaryOp {
-	return func(a Value) Value {
-		return FloatValue(op(float64(asFloat(a))))
+func (op binaryOp) callList(a, b Value, ta, tb valueType) Value {
+	switch {
+	case ta == listType && tb == listType && op.list != nil:
+		return op.list(a.(ListValue), b.(ListValue))
+	case ta == listType && tb == intType && op.listInt != nil:
+		return op.listInt(a.(ListValue), b.(IntValue))
+	case op.list != nil && op.listInt == nil && !op.logical && ta == listType && tb == intType:
+		return op.list(a.(ListValue), a.(ListValue).itemWithValue(b.(IntValue)))
+	case op.list != nil && op.listInt == nil && !op.logical && ta == intType && tb == listType:
+		return op.list(b.(ListValue).itemWithValue(a.(IntValue)), b.(ListValue))
+	case op.logical:
+		return op.int(boolInt(boolean(truthy(a))), boolInt(boolean(truthy(b))))
 	}
+	panic(inkErrorf("cannot perform operation '%s' on %s and %s", op.name, ta, tb))
 }
 
-var Floor UnaryOp = floatOp(math.Floor)
+// valueType orders the types of values by how they're promoted when an
+// operator is given different types, so an int and a float are both treated
+// as floats, and anything combined with a string is treated as a string.
+type valueType int
 
-var Ceiling UnaryOp = floatOp(math.Ceil)
+const (
+	boolType valueType = iota
+	intType
+	floatType
+	listType
+	stringType
+	divertType
+)
 
-var Int UnaryOp = func(a Value) Value {
-	return IntValue(a.(FloatValue))
+func (t valueType) String() string {
+	switch t {
+	case boolType:
+		return "Bool"
+	case intType:
+		return "Int"
+	case floatType:
+		return "Float"
+	case listType:
+		return "List"
+	case stringType:
+		return "String"
+	case divertType:
+		return "DivertTarget"
+	default:
+		return fmt.Sprintf("valueType(%d)", int(t))
+	}
 }
 
-type BinOp func(a, b Value) Value
-
-var Add BinOp = func(a, b Value) Value {
-	// if "a" is a string, this takes precedence over numeric conversions
-	switch a := a.(type) {
-	case StringValue:
-		return a + asStringValue(b)
-	}
-	switch bt := b.(type) {
-	case StringValue:
-		return asStringValue(a) + bt
-	case FloatValue:
-		a = asFloat(a)
+func typeOf(v Value) valueType {
+	switch v.(type) {
 	case BoolValue:
-		b = boolInt(bt)
-	}
-	switch a := a.(type) {
-	case FloatValue:
-		return a + asFloat(b)
+		return boolType
 	case IntValue:
-		return a + b.(IntValue)
+		return intType
+	case FloatValue:
+		return floatType
 	case ListValue:
-		return a.Add(b)
-	case BoolValue:
-		return boolInt(a) + b.(IntValue)
+		return listType
+	case StringValue:
+		return stringType
+	case DivertTargetValue:
+		return divertType
+	case VoidValue:
+		panic(inkErrorf("attempting to perform operation on a void value, did you forget to 'return' a value from a function you called here?"))
 	default:
-		panic(fmt.Errorf("unsupported type %T", a))
+		panic(inkErrorf("unsupported type %T", v))
 	}
 }
 
+// coerce promotes v to type t, which must be the same or a higher type.
+func coerce(v Value, t valueType) Value {
+	if typeOf(v) == t {
+		return v
+	}
+	switch t {
+	case intType:
+		if v, ok := v.(BoolValue); ok {
+			return boolInt(v)
+		}
+	case floatType:
+		return asFloat(v)
+	case stringType:
+		return asStringValue(v)
+	}
+	panic(inkErrorf("cannot convert %s to %s", typeOf(v), t))
+}
+
 func boolInt(b BoolValue) IntValue {
 	if b {
 		return 1
@@ -185,68 +335,13 @@ func boolInt(b BoolValue) IntValue {
 }
 
 func asStringValue(v Value) StringValue {
-	if v, ok := v.(StringValue); ok {
-		return v
-	}
-	if v, ok := v.(Outputter); ok {
-		return StringValue(v.Output().String())
-	}
-	panic(fmt.Errorf("unsupported type %T", v))
-}
-
-var Has BinOp = func(a, b Value) Value {
-	switch a := a.(type) {
-	case ListValue:
-		return boolean(a.Contains(b.(ListValue)))
+	switch v := v.(type) {
 	case StringValue:
-		return boolean(strings.Contains(string(a), string(asStringValue(b))))
-	default:
-		panic(fmt.Errorf("unsupported type %T", a))
-	}
-}
-
-var Hasnt BinOp = func(a, b Value) Value {
-	return Not(Has(a, b))
-}
-
-var Sub BinOp = func(a, b Value) Value {
-	switch bt := b.(type) {
-	case FloatValue:
-		a = asFloat(a)
-	case BoolValue:
-		b = boolInt(bt)
-	}
-	switch a := a.(type) {
-	case FloatValue:
-		return a - asFloat(b)
-	case IntValue:
-		return a - b.(IntValue)
-	case ListValue:
-		return a.Sub(b)
-	case BoolValue:
-		return boolInt(a) - b.(IntValue)
-	default:
-		panic(fmt.Errorf("unsupported type %T", a))
-	}
-}
-
-var Div BinOp = func(a, b Value) Value {
-	switch bt := b.(type) {
-	case FloatValue:
-		a = asFloat(a)
-	case BoolValue:
-		b = boolInt(bt)
-	}
-	switch a := a.(type) {
-	case FloatValue:
-		return a / asFloat(b)
-	case IntValue:
-		return a / b.(IntValue)
-	case BoolValue:
-		return boolInt(a) / b.(IntValue)
-	default:
-		panic(fmt.Errorf("unsupported type %T", a))
+		return v
+	case IntValue, FloatValue, BoolValue:
+		return StringValue(v.(Outputter).Output().String())
 	}
+	panic(inkErrorf("cannot convert %s to %s", typeOf(v), stringType))
 }
 
 func asFloat(v Value) FloatValue {
@@ -257,178 +352,159 @@ func asFloat(v Value) FloatValue {
 		return FloatValue(v)
 	case BoolValue:
 		return FloatValue(boolInt(v))
-	default:
-		panic(fmt.Errorf("unsupported type %T", v))
-	}
-}
-
-var Mul BinOp = func(a, b Value) Value {
-	switch bt := b.(type) {
-	case FloatValue:
-		a = asFloat(a)
-	case BoolValue:
-		b = boolInt(bt)
-	}
-	switch a := a.(type) {
-	case FloatValue:
-		return a * asFloat(b)
-	case IntValue:
-		return a * b.(IntValue)
-	case BoolValue:
-		return boolInt(a) * b.(IntValue)
-	default:
-		panic(fmt.Errorf("unsupported type %T", a))
-	}
-}
-
-var Mod BinOp = func(a, b Value) Value {
-	switch bt := b.(type) {
-	case FloatValue:
-		a = asFloat(a)
-	case BoolValue:
-		b = boolInt(bt)
-	}
-	switch a := a.(type) {
-	case FloatValue:
-		return FloatValue(math.Mod(float64(a), float64(asFloat(b))))
-	case IntValue:
-		return a % b.(IntValue)
-	case BoolValue:
-		return boolInt(a) % b.(IntValue)
-	default:
-		panic(fmt.Errorf("unsupported type %T", a))
-	}
-}
-
-var Eq BinOp = func(a, b Value) Value {
-	if eq, ok := a.(interface {
-		Eq(b Value) bool
-	}); ok {
-		return boolean(eq.Eq(b))
-	}
-	// if one of the value is a string, try comparing as strings
-	if _, ok := a.(StringValue); ok {
-		b = asStringValue(b)
-	} else if _, ok := b.(StringValue); ok {
-		a = asStringValue(a)
-	}
-	return boolean(a == b)
-}
-
-var Ne BinOp = func(a, b Value) Value {
-	return Not(Eq(a, b))
-}
-
-var And BinOp = func(a, b Value) Value {
-	return boolean(truthy(a) && truthy(b))
-}
-
-var Or BinOp = func(a, b Value) Value {
-	return boolean(truthy(a) || truthy(b))
-}
-
-var Lt BinOp = func(a, b Value) Value {
-	if a, ok := a.(interface {
-		Lt(b Value) bool
-	}); ok {
-		return boolean(a.Lt(b))
-	}
-	switch a := a.(type) {
-	case FloatValue:
-		return boolean(a < b.(FloatValue))
-	case IntValue:
-		return boolean(a < b.(IntValue))
-	default:
-		panic(fmt.Errorf("unsupported type %T", a))
-	}
-}
-
-var Gt BinOp = func(a, b Value) Value {
-	if a, ok := a.(interface {
-		Gt(b Value) bool
-	}); ok {
-		return boolean(a.Gt(b))
-	}
-	return Lt(b, a)
-}
-
-var Lte BinOp = func(a, b Value) Value {
-	if a, ok := a.(interface {
-		Lte(b Value) bool
-	}); ok {
-		return boolean(a.Lte(b))
-	}
-	return Or(
-		Lt(a, b),
-		Eq(a, b),
-	)
-}
-
-var Gte BinOp = func(a, b Value) Value {
-	if a, ok := a.(interface {
-		Gte(b Value) bool
-	}); ok {
-		return boolean(a.Gte(b))
-	}
-	return Lte(b, a)
-}
-
-var Min BinOp = func(a, b Value) Value {
-	if truthy(Lt(b, a)) {
-		return b
-	}
-	return a
-}
-
-var Max BinOp = func(a, b Value) Value {
-	if truthy(Gt(b, a)) {
-		return b
-	}
-	return a
-}
-
-// TODO the source should be stored in the stack so that if there are
-// concurrent stories they each have their own random state.
-// However, we'll just use a global random source for now.
-// Since PGC uses a simple internal state, we could also copy the struct
-// to preserve its state after each call to ensure determinism.
-var (
-	randSource *rand.Rand
-	storySeed  uint64
-)
-
-func seedRandom(seed uint64) {
-	storySeed = seed
-	randSource = rand.New(rand.NewPCG(0, seed))
-}
-
-var Rnd BinOp = func(a, b Value) Value {
-	if randSource == nil {
-		seedRandom(rand.Uint64())
 	}
-	lo := int64(a.(IntValue))
-	hi := int64(b.(IntValue))
-	r := lo + randSource.Int64N(hi-lo)
-	return IntValue(r)
-}
-
-var Srnd UnaryOp = func(v Value) Value {
-	seedRandom(uint64(v.(IntValue)))
-	return VoidValue{}
-}
-
-func shuffle(container string, elements, visitIndex int) int {
-	h := fnv.New64a()
-	_, err := io.WriteString(h, container)
-	if err != nil {
-		panic(err)
-	}
-	loop := visitIndex / elements
-	seed := h.Sum64() + uint64(loop)
-	src := rand.New(rand.NewPCG(seed, storySeed))
-	perm := src.Perm(elements)
-	return perm[visitIndex%elements]
-}
+	panic(inkErrorf("cannot convert %s to %s", typeOf(v), floatType))
+}
+
+var errDivideByZero = errors.New("attempted to divide by zero")
+
+var Add BinOp = binaryOp{
+	name:    "+",
+	int:     func(a, b IntValue) Value { return a + b },
+	float:   func(a, b FloatValue) Value { return a + b },
+	str:     func(a, b StringValue) Value { return a + b },
+	list:    func(a, b ListValue) Value { return a.Add(b) },
+	listInt: func(a ListValue, b IntValue) Value { return a.Add(b) },
+}.call
+
+var Sub BinOp = binaryOp{
+	name:    "-",
+	int:     func(a, b IntValue) Value { return a - b },
+	float:   func(a, b FloatValue) Value { return a - b },
+	list:    func(a, b ListValue) Value { return a.Sub(b) },
+	listInt: func(a ListValue, b IntValue) Value { return a.Sub(b) },
+}.call
+
+var Mul BinOp = binaryOp{
+	name:  "*",
+	int:   func(a, b IntValue) Value { return a * b },
+	float: func(a, b FloatValue) Value { return a * b },
+}.call
+
+var Div BinOp = binaryOp{
+	name: "/",
+	int: func(a, b IntValue) Value {
+		if b == 0 {
+			panic(inkError{errDivideByZero})
+		}
+		return a / b
+	},
+	float: func(a, b FloatValue) Value { return a / b },
+}.call
+
+var Mod BinOp = binaryOp{
+	name: "%",
+	int: func(a, b IntValue) Value {
+		if b == 0 {
+			panic(inkError{errDivideByZero})
+		}
+		return a % b
+	},
+	float: func(a, b FloatValue) Value {
+		return FloatValue(math.Mod(float64(a), float64(b)))
+	},
+}.call
+
+var Pow BinOp = binaryOp{
+	name: "POW",
+	// the result is a float even for ints, as in the reference runtime
+	int: func(a, b IntValue) Value {
+		return FloatValue(math.Pow(float64(a), float64(b)))
+	},
+	float: func(a, b FloatValue) Value {
+		return FloatValue(math.Pow(float64(a), float64(b)))
+	},
+}.call
+
+var Has BinOp = binaryOp{
+	name: "?",
+	str: func(a, b StringValue) Value {
+		return boolean(strings.Contains(string(a), string(b)))
+	},
+	list: func(a, b ListValue) Value { return boolean(a.Contains(b)) },
+}.call
+
+var Hasnt BinOp = binaryOp{
+	name: "!?",
+	str: func(a, b StringValue) Value {
+		return boolean(!strings.Contains(string(a), string(b)))
+	},
+	list: func(a, b ListValue) Value { return boolean(!a.Contains(b)) },
+}.call
+
+var Eq BinOp = binaryOp{
+	name:   "==",
+	int:    func(a, b IntValue) Value { return boolean(a == b) },
+	float:  func(a, b FloatValue) Value { return boolean(a == b) },
+	str:    func(a, b StringValue) Value { return boolean(a == b) },
+	list:   func(a, b ListValue) Value { return boolean(a.Eq(b)) },
+	divert: func(a, b DivertTargetValue) Value { return boolean(a == b) },
+}.call
+
+var Ne BinOp = binaryOp{
+	name:   "!=",
+	int:    func(a, b IntValue) Value { return boolean(a != b) },
+	float:  func(a, b FloatValue) Value { return boolean(a != b) },
+	str:    func(a, b StringValue) Value { return boolean(a != b) },
+	list:   func(a, b ListValue) Value { return boolean(!a.Eq(b)) },
+	divert: func(a, b DivertTargetValue) Value { return boolean(a != b) },
+}.call
+
+var And BinOp = binaryOp{
+	name:    "&&",
+	int:     func(a, b IntValue) Value { return boolean(a != 0 && b != 0) },
+	float:   func(a, b FloatValue) Value { return boolean(a != 0 && b != 0) },
+	list:    func(a, b ListValue) Value { return boolean(truthy(a) && truthy(b)) },
+	logical: true,
+}.call
+
+var Or BinOp = binaryOp{
+	name:    "||",
+	int:     func(a, b IntValue) Value { return boolean(a != 0 || b != 0) },
+	float:   func(a, b FloatValue) Value { return boolean(a != 0 || b != 0) },
+	list:    func(a, b ListValue) Value { return boolean(truthy(a) || truthy(b)) },
+	logical: true,
+}.call
+
+var Lt BinOp = binaryOp{
+	name:  "<",
+	int:   func(a, b IntValue) Value { return boolean(a < b) },
+	float: func(a, b FloatValue) Value { return boolean(a < b) },
+	list:  func(a, b ListValue) Value { return boolean(a.Lt(b)) },
+}.call
+
+var Gt BinOp = binaryOp{
+	name:  ">",
+	int:   func(a, b IntValue) Value { return boolean(a > b) },
+	float: func(a, b FloatValue) Value { return boolean(a > b) },
+	list:  func(a, b ListValue) Value { return boolean(b.Lt(a)) },
+}.call
+
+var Lte BinOp = binaryOp{
+	name:  "<=",
+	int:   func(a, b IntValue) Value { return boolean(a <= b) },
+	float: func(a, b FloatValue) Value { return boolean(a <= b) },
+	list:  func(a, b ListValue) Value { return boolean(a.Lte(b)) },
+}.call
+
+var Gte BinOp = binaryOp{
+	name:  ">=",
+	int:   func(a, b IntValue) Value { return boolean(a >= b) },
+	float: func(a, b FloatValue) Value { return boolean(a >= b) },
+	list:  func(a, b ListValue) Value { return boolean(b.Lte(a)) },
+}.call
+
+var Min BinOp = binaryOp{
+	name:  "MIN",
+	int:   func(a, b IntValue) Value { return min(a, b) },
+	float: func(a, b FloatValue) Value { return min(a, b) },
+}.call
+
+var Max BinOp = binaryOp{
+	name:  "MAX",
+	int:   func(a, b IntValue) Value { return max(a, b) },
+	float: func(a, b FloatValue) Value { return max(a, b) },
+}.call
 
 type SetTemp struct {
 	Name     string `json:"temp="`
@@ -461,6 +537,10 @@ func (s StringValue) Output() Output {
 	return Output(s)
 }
 
+// TagValue is a tag from the text of a choice, which is kept on the eval stack
+// until the choice point collects it.
+type TagValue string
+
 type VoidValue struct{}
 
 func (v VoidValue) Output() Output {
@@ -492,6 +572,41 @@ func (b BoolValue) Output() Output {
 type ListValue struct {
 	Items   []ListItem          `json:"list"`
 	Origins map[string]struct{} `json:"origins"`
+	// inserted is the items in the order they were added to the list, when
+	// that's different from the sorted order of Items. LIST_RANDOM picks from
+	// the items in this order, as the reference runtime does.
+	inserted []ListItem
+}
+
+// withItems returns the list with the items, given in the order they were
+// added to it.
+func (l ListValue) withItems(order []ListItem) ListValue {
+	l.Items = slices.SortedFunc(slices.Values(order), func(a, b ListItem) int {
+		if c := cmp.Compare(a.Value, b.Value); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Origin, b.Origin)
+	})
+	l.inserted = nil
+	if !slices.Equal(l.Items, order) {
+		l.inserted = order
+	}
+	return l
+}
+
+// insertionOrder returns the items in the order they were added to the list.
+func (l ListValue) insertionOrder() []ListItem {
+	if l.inserted != nil {
+		return l.inserted
+	}
+	return l.Items
+}
+
+// sorted forgets the order the items were added in, for lists built from
+// unordered sources such as the list definitions.
+func (l ListValue) sorted() ListValue {
+	l.inserted = nil
+	return l
 }
 
 func ListEmpty(origin string) ListValue {
@@ -563,11 +678,11 @@ func numeric(v Value) int {
 		return int(v)
 	case ListValue:
 		if len(v.Items) != 1 {
-			panic(fmt.Errorf("should have 1 item to treat as number"))
+			panic(inkErrorf("should have 1 item to treat as number"))
 		}
 		return v.Items[0].Value
 	default:
-		panic(fmt.Errorf("unexpected type %T", v))
+		panic(inkErrorf("unexpected type %T", v))
 	}
 }
 
@@ -592,7 +707,7 @@ func (l ListValue) Contains(v ListValue) bool {
 }
 
 func (l ListValue) contains(x ListItem) bool {
-	return slices.Contains(l.Items, x)
+	return slices.ContainsFunc(l.Items, x.same)
 }
 
 func (l ListValue) Eq(v Value) bool {
@@ -600,23 +715,36 @@ func (l ListValue) Eq(v Value) bool {
 	if !ok {
 		return false
 	}
-	return slices.Equal(l.Items, l2.Items)
+	return slices.EqualFunc(l.Items, l2.Items, ListItem.same)
+}
+
+// itemWithValue converts an int to a list, for comparing it with the list. As
+// in the reference runtime, the int is the item with that value from the
+// origin of the list's highest item. The item's name isn't known without the
+// list definitions, so it's only matched by its origin and value.
+func (l ListValue) itemWithValue(v IntValue) ListValue {
+	if len(l.Items) == 0 {
+		panic(inkErrorf("cannot convert Int to List, since the list is empty"))
+	}
+	origin := l.Items[len(l.Items)-1].Origin
+	return ListValue{}.withItems([]ListItem{{Origin: origin, Value: int(v)}})
 }
 
 func (l ListValue) Resolve(defs ListDefs) ListValue {
 	r := ListValue{
 		Origins: make(map[string]struct{}),
 	}
-	for _, item := range l.Items {
+	var order []ListItem
+	for _, item := range l.insertionOrder() {
 		if item.Name != "" {
-			r.Items = append(r.Items, item)
+			order = append(order, item)
 			r.Origins[item.Origin] = struct{}{}
 			continue
 		}
 		if o, ok := defs[item.Origin]; ok {
 			for name, value := range o {
 				if value == item.Value {
-					r.Items = append(r.Items, ListItem{
+					order = append(order, ListItem{
 						Origin: item.Origin,
 						Name:   name,
 						Value:  value,
@@ -626,6 +754,7 @@ func (l ListValue) Resolve(defs ListDefs) ListValue {
 			}
 		}
 	}
+	r = r.withItems(order)
 	if len(r.Items) == 0 {
 		r.Origins = l.Origins
 	}
@@ -643,7 +772,7 @@ func (l ListValue) Add(v Value) ListValue {
 	case IntValue:
 		return l.inc(int(v))
 	default:
-		panic(fmt.Errorf("unsupported type %T", v))
+		panic(inkErrorf("unsupported type %T", v))
 	}
 }
 
@@ -654,7 +783,7 @@ func (l ListValue) Sub(v Value) ListValue {
 	case IntValue:
 		return l.inc(-int(v))
 	default:
-		panic(fmt.Errorf("unsupported type %T", v))
+		panic(inkErrorf("unsupported type %T", v))
 	}
 }
 
@@ -666,27 +795,27 @@ func (l ListValue) Intersect(v ListValue) ListValue {
 
 func (l ListValue) inc(v int) ListValue {
 	var items []ListItem
-	for _, item := range l.Items {
+	for _, item := range l.insertionOrder() {
 		items = append(items, ListItem{
 			Origin: item.Origin,
 			Value:  item.Value + v,
 		})
 	}
-	return ListValue{
-		Items: items,
-	}
+	return ListValue{}.withItems(items)
 }
 
 func (l ListValue) filter(m ListValue, p func(ListItem) bool) ListValue {
 	r := ListValue{
 		Origins: make(map[string]struct{}),
 	}
-	for _, item := range l.Items {
+	var order []ListItem
+	for _, item := range l.insertionOrder() {
 		if p(item) {
-			r.Items = append(r.Items, item)
+			order = append(order, item)
 			r.Origins[item.Origin] = struct{}{}
 		}
 	}
+	r = r.withItems(order)
 	if len(r.Items) == 0 {
 		r.Origins = l.Origins
 	}
@@ -699,24 +828,21 @@ func (l ListValue) diff(m ListValue) ListValue {
 	})
 }
 
+// merge returns the union of the lists, with the items of m that aren't in l
+// added after the items of l, as in the reference runtime.
 func (l ListValue) merge(m ListValue) ListValue {
-	var items []ListItem
-	items = append(items, l.Items...)
-	items = append(items, m.Items...)
-	slices.SortFunc(items, func(a, b ListItem) int {
-		if c := cmp.Compare(a.Value, b.Value); c != 0 {
-			return c
+	order := slices.Clone(l.insertionOrder())
+	for _, item := range m.insertionOrder() {
+		if !slices.Contains(order, item) {
+			order = append(order, item)
 		}
-		return cmp.Compare(a.Origin, b.Origin)
-	})
-	items = slices.Compact(items)
+	}
 	r := ListValue{
-		Items:   items,
 		Origins: make(map[string]struct{}),
 	}
 	maps.Copy(r.Origins, l.Origins)
 	maps.Copy(r.Origins, m.Origins)
-	return r
+	return r.withItems(order)
 }
 
 func (l ListValue) Output() Output {
@@ -740,10 +866,16 @@ func truthy(v Value) bool {
 		return bool(v)
 	case IntValue:
 		return v != 0
+	case FloatValue:
+		return v != 0
+	case StringValue:
+		return len(v) > 0
 	case ListValue:
 		return len(v.Items) > 0
+	case DivertTargetValue:
+		panic(inkErrorf("divert targets have no truthiness"))
 	default:
-		panic(fmt.Errorf("unsupported type %T", v))
+		panic(inkErrorf("unsupported type %T", v))
 	}
 }
 
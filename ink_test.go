@@ -101,6 +101,12 @@ func TestLookupIndex(t *testing.T) {
 	first := root.First()
 	elem, _ := first.Find("1")
 	assert.Equal(t, Text("root 1"), elem.Node())
+
+	// indexes outside the container aren't found
+	elem, _ = first.Find("-1")
+	assert.Nil(t, elem)
+	elem, _ = first.Find("3")
+	assert.Nil(t, elem)
 }
 
 func TestContainerElementContinuation(t *testing.T) {
@@ -270,34 +276,37 @@ type stringWriteFunc func(string) (int, error)
 
 func (f stringWriteFunc) WriteString(s string) (int, error) { return f(s) }
 
+var samples = []string{
+	"choice-condition",
+	"choice-count",
+	"choice-func-content",
+	"func-abs",
+	"func-text-content",
+	"func-return-eval",
+	"global",
+	"glue",
+	"if-else",
+	"math",
+	"math-type-coercion",
+	"math-functions",
+	"list-basics",
+	"pop",
+	"random",
+	"random-shuffle",
+	"random-shuffle-text",
+	"sample",
+	"seq-text",
+	"stitch",
+	"tempvar",
+	"threads",
+	"tunnels",
+	"turn-count",
+	"var-ref",
+	"visit-count",
+}
+
 func TestSamples(t *testing.T) {
-	for _, name := range []string{
-		"choice-condition",
-		"choice-count",
-		"choice-func-content",
-		"func-abs",
-		"func-text-content",
-		"func-return-eval",
-		"global",
-		"glue",
-		"if-else",
-		"math",
-		"math-type-coercion",
-		"list-basics",
-		"pop",
-		"random",
-		"random-shuffle",
-		"random-shuffle-text",
-		"sample",
-		"seq-text",
-		"stitch",
-		"tempvar",
-		"threads",
-		"tunnels",
-		"turn-count",
-		"var-ref",
-		"visit-count",
-	} {
+	for _, name := range samples {
 		t.Run(name, func(t *testing.T) {
 			base := "./testdata/" + name + ".ink"
 			expected := readfile(t, base+".txt")
@@ -39,11 +39,9 @@ func TestInkProofBytecode(t *testing.T) {
 			input := openfile(t, filepath.Join(base, "input.txt"))
 			container, listDefs := load(t, filepath.Join(base, "bytecode.json"))
 			var b strings.Builder
-			w := glue.NewWriter(&b)
-			root, eval := Init(container, listDefs)
-			choices := ContinueT(t, w, eval, root)
-			for len(choices) > 0 {
-				w.WriteEnd()
+			story := mustNewStory(t, container, listDefs)
+			b.WriteString(mustContinue(t, story))
+			for choices := story.CurrentChoices(); len(choices) > 0; choices = story.CurrentChoices() {
 				b.WriteRune('\n')
 				for i, choice := range choices {
 					b.WriteString(fmt.Sprintf("%d: %s\n", i+1, choice.Label))
@@ -51,10 +49,9 @@ func TestInkProofBytecode(t *testing.T) {
 				b.WriteString("?> ")
 				var choiceNum int
 				fmt.Fscanln(input, &choiceNum)
-				choice := choices[choiceNum-1]
-				choices = ContinueT(t, w, choice.Eval, choice.Dest)
+				require.NoError(t, story.ChooseChoiceIndex(choiceNum-1))
+				b.WriteString(mustContinue(t, story))
 			}
-			w.WriteEnd()
 			actual := b.String()
 			assert.Equal(t, expected, actual)
 		})
@@ -126,17 +123,12 @@ func TestInkProofInk(t *testing.T) {
 			container, listDefs := load(t, filepath.Join(base, "story.ink.json"))
 			var b strings.Builder
 			w := glue.NewWriter(&b)
-			write := stringWriteFunc(func(s string) (int, error) {
-				t.Logf("%q", s)
-				return w.WriteString(s)
-			})
-			root, eval := Init(container, listDefs)
-			choices := ContinueT(t, write, eval, root)
-			for len(choices) > 0 {
-				w.WriteEnd()
+			story := mustNewStory(t, container, listDefs)
+			b.WriteString(mustContinue(t, story))
+			for choices := story.CurrentChoices(); len(choices) > 0; choices = story.CurrentChoices() {
 				b.WriteRune('\n')
 				for i, choice := range choices {
-					write(fmt.Sprintf("%d: %s\n", i+1, choice.Label))
+					w.WriteString(fmt.Sprintf("%d: %s\n", i+1, choice.Label))
 				}
 				w.WriteEnd()
 				b.WriteString("?> ")
@@ -144,10 +136,9 @@ func TestInkProofInk(t *testing.T) {
 				if _, err := fmt.Fscanln(input, &choiceNum); err != nil {
 					t.Fatalf("unable to read choice input: %s", err)
 				}
-				choice := choices[choiceNum-1]
-				choices = ContinueT(t, write, choice.Eval, choice.Dest)
+				require.NoError(t, story.ChooseChoiceIndex(choiceNum-1))
+				b.WriteString(mustContinue(t, story))
 			}
-			w.WriteEnd()
 			actual := b.String()
 			if !strings.HasSuffix(actual, "\n") {
 				actual += "\n"
@@ -1,19 +1,56 @@
 package gouache
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"slices"
 	"strings"
 )
 
 var ErrUnsupportedVersion = fmt.Errorf("unsupported version")
 
+// LoadProblem is an invalid value found while loading a story, with its
+// location in the JSON, such as "root.0.tavern.3".
+type LoadProblem struct {
+	Path    string
+	Message string
+}
+
+func (p LoadProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// LoadError lists all of the problems found while loading a story.
+type LoadError struct {
+	Problems []LoadProblem
+}
+
+func (e *LoadError) Error() string {
+	return formatProblems("invalid story", e.Problems)
+}
+
+func formatProblems(prefix string, problems []LoadProblem) string {
+	if len(problems) == 1 {
+		return fmt.Sprintf("%s: %s", prefix, problems[0])
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d problems", prefix, len(problems))
+	for _, p := range problems {
+		fmt.Fprintf(&b, "\n\t%s", p)
+	}
+	return b.String()
+}
+
+// LoadJSON loads a story compiled to JSON by inklecate. Any problems with the
+// contents of the story are returned as a *LoadError.
 func LoadJSON(r io.Reader) (Container, ListDefs, error) {
 	var b struct {
-		Version  int      `json:"inkVersion"`
-		Root     []any    `json:"root"`
-		ListDefs ListDefs `json:"listDefs"`
+		Version  int `json:"inkVersion"`
+		Root     any `json:"root"`
+		ListDefs any `json:"listDefs"`
 	}
 	dec := json.NewDecoder(r)
 	dec.UseNumber()
@@ -23,25 +60,77 @@ func LoadJSON(r io.Reader) (Container, ListDefs, error) {
 	if b.Version < MinInkVersion || b.Version > MaxInkVersion {
 		return Container{}, nil, ErrUnsupportedVersion
 	}
-	return LoadContainer(b.Root), b.ListDefs, nil
+	var l loader
+	var c Container
+	if root, ok := b.Root.([]any); ok {
+		c = l.container("root", root)
+	} else {
+		l.errorf("root", "expected an array, found %s", jsonType(b.Root))
+	}
+	listDefs := l.listDefs("listDefs", b.ListDefs)
+	if len(l.problems) > 0 {
+		return Container{}, nil, &LoadError{Problems: l.problems}
+	}
+	return c, listDefs, nil
+}
+
+// ParseContainer loads the root container of a story from its decoded JSON.
+// The JSON must be decoded with json.Decoder.UseNumber. Any problems with the
+// contents are returned as a *LoadError.
+func ParseContainer(contents []any) (Container, error) {
+	var l loader
+	c := l.container("root", contents)
+	if len(l.problems) > 0 {
+		return Container{}, &LoadError{Problems: l.problems}
+	}
+	return c, nil
 }
 
+// LoadContainer is like ParseContainer, but panics with the *LoadError if
+// there are any problems with the contents.
 func LoadContainer(contents []any) Container {
+	c, err := ParseContainer(contents)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+type loader struct {
+	problems []LoadProblem
+}
+
+func (l *loader) errorf(path, format string, args ...any) {
+	l.problems = append(l.problems, LoadProblem{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *loader) container(path string, contents []any) Container {
 	var c Container
+	if len(contents) == 0 {
+		l.errorf(path, "container must end with a metadata element")
+		return c
+	}
 	meta := contents[len(contents)-1]
-	if meta != nil {
-		for k, v := range meta.(map[string]any) {
+	switch meta := meta.(type) {
+	case nil:
+	case map[string]any:
+		for _, k := range slices.Sorted(maps.Keys(meta)) {
+			v := meta[k]
 			switch k {
 			case "#n":
-				c.Name = v.(string)
+				c.Name = l.string(path+".#n", v)
 			case "#f":
-				f, err := v.(json.Number).Float64()
-				if err != nil {
-					panic(err)
-				}
-				c.Flags = ContainerFlag(f)
+				c.Flags = ContainerFlag(l.int(path+".#f", v))
 			default:
-				n := LoadContainer(v.([]any))
+				nested, ok := v.([]any)
+				if !ok {
+					l.errorf(path+"."+k, "expected a container, found %s", jsonType(v))
+					continue
+				}
+				n := l.container(path+"."+k, nested)
 				n.Name = k
 				if c.Nested == nil {
 					c.Nested = make(map[string]Container)
@@ -49,27 +138,110 @@ func LoadContainer(contents []any) Container {
 				c.Nested[k] = n
 			}
 		}
+	default:
+		l.errorf(fmt.Sprintf("%s.%d", path, len(contents)-1), "expected container metadata, found %s", jsonType(meta))
 	}
 	c.Contents = make([]Node, 0, len(contents)-1)
-	for _, n := range contents[:len(contents)-1] {
-		c.Contents = append(c.Contents, loadNode(n))
+	for i, n := range contents[:len(contents)-1] {
+		c.Contents = append(c.Contents, l.node(fmt.Sprintf("%s.%d", path, i), n))
 	}
 	return c
 }
 
-func loadNode(n any) Node {
+func (l *loader) listDefs(path string, v any) ListDefs {
+	if v == nil {
+		return nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		l.errorf(path, "expected an object, found %s", jsonType(v))
+		return nil
+	}
+	defs := make(ListDefs, len(m))
+	for _, origin := range slices.Sorted(maps.Keys(m)) {
+		items, ok := m[origin].(map[string]any)
+		if !ok {
+			l.errorf(path+"."+origin, "expected an object, found %s", jsonType(m[origin]))
+			continue
+		}
+		defs[origin] = make(map[string]int, len(items))
+		for _, name := range slices.Sorted(maps.Keys(items)) {
+			defs[origin][name] = l.int(path+"."+origin+"."+name, items[name])
+		}
+	}
+	return defs
+}
+
+func (l *loader) string(path string, v any) string {
+	s, ok := v.(string)
+	if !ok {
+		l.errorf(path, "expected a string, found %s", jsonType(v))
+	}
+	return s
+}
+
+func (l *loader) bool(path string, v any) bool {
+	b, ok := v.(bool)
+	if !ok {
+		l.errorf(path, "expected a bool, found %s", jsonType(v))
+	}
+	return b
+}
+
+func (l *loader) int(path string, v any) int {
+	n, ok := v.(json.Number)
+	if !ok {
+		l.errorf(path, "expected an integer, found %s", jsonType(v))
+		return 0
+	}
+	i, err := n.Int64()
+	if err != nil {
+		l.errorf(path, "expected an integer, found %s", n)
+	}
+	return int(i)
+}
+
+// optBool returns the value of an optional bool field of a node.
+func (l *loader) optBool(path string, n map[string]any, key string) bool {
+	v, ok := n[key]
+	if !ok {
+		return false
+	}
+	return l.bool(path+"."+key, v)
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case json.Number:
+		return fmt.Sprintf("number %s", v)
+	case bool:
+		return fmt.Sprintf("bool %v", v)
+	case []any:
+		return "array"
+	case map[string]any, jsonObject:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func (l *loader) node(path string, n any) Node {
 	switch n := n.(type) {
 	case json.Number:
-		if s := n.String(); strings.Contains(s, ".") {
+		if s := n.String(); strings.ContainsAny(s, ".eE") {
 			f, err := n.Float64()
 			if err != nil {
-				panic(err)
+				l.errorf(path, "invalid float %s", n)
 			}
 			return FloatValue(f)
 		}
 		i, err := n.Int64()
 		if err != nil {
-			panic(err)
+			l.errorf(path, "invalid integer %s", n)
 		}
 		return IntValue(i)
 	case bool:
@@ -140,6 +312,8 @@ func loadNode(n any) Node {
 			return ListIntersectFunc{}
 		case "range":
 			return ListRangeFunc{}
+		case "lrnd":
+			return ListRandomFunc{}
 		case "+":
 			return Add
 		case "-":
@@ -178,132 +352,237 @@ func loadNode(n any) Node {
 			return Min
 		case "MAX":
 			return Max
+		case "POW":
+			return Pow
 		case "FLOOR":
 			return Floor
 		case "INT":
 			return Int
+		case "FLOAT":
+			return Float
 		case "CEILING":
 			return Ceiling
 		case "srnd":
-			return Srnd
+			return SeedRandom{}
 		case "rnd":
-			return Rnd
+			return Random{}
 		case "seq":
 			return Seq{}
 		}
 		if s, found := strings.CutPrefix(n, "^"); found {
 			return Text(s)
 		}
-		panic(fmt.Errorf("unsupported node: %q", n))
+		l.errorf(path, "unsupported control command %q", n)
+		return nil
 	case map[string]any:
 		if v, ok := n["*"]; ok {
-			flg, err := n["flg"].(json.Number).Int64()
-			if err != nil {
-				panic(err)
+			flg, ok := n["flg"]
+			if !ok {
+				l.errorf(path, "choice point is missing \"flg\"")
 			}
 			return ChoicePoint{
-				Dest:  Address(v.(string)),
-				Flags: ChoicePointFlag(flg),
+				Dest:  Address(l.string(path+".*", v)),
+				Flags: ChoicePointFlag(l.int(path+".flg", flg)),
 			}
 		}
 		if v, ok := n["->"]; ok {
-			r := Divert{
-				Dest: Address(v.(string)),
-			}
-			if v, ok := n["var"]; ok {
-				r.Var = v.(bool)
-			}
-			if c, ok := n["c"]; ok {
-				r.Conditional = c.(bool)
+			return Divert{
+				Dest:        Address(l.string(path+".->", v)),
+				Var:         l.optBool(path, n, "var"),
+				Conditional: l.optBool(path, n, "c"),
 			}
-			return r
 		}
 		if v, ok := n["^->"]; ok {
 			return DivertTargetValue{
-				Dest: Address(v.(string)),
+				Dest: Address(l.string(path+".^->", v)),
 			}
 		}
 		if v, ok := n["temp="]; ok {
-			r := SetTemp{
-				Name: v.(string),
+			return SetTemp{
+				Name:     l.string(path+".temp=", v),
+				Reassign: l.optBool(path, n, "re"),
 			}
-			if v, ok := n["re"]; ok {
-				r.Reassign = v.(bool)
-			}
-			return r
 		}
 		if v, ok := n["VAR="]; ok {
-			r := SetVar{
-				Name: v.(string),
-			}
-			if v, ok := n["re"]; ok {
-				r.Reassign = v.(bool)
+			return SetVar{
+				Name:     l.string(path+".VAR=", v),
+				Reassign: l.optBool(path, n, "re"),
 			}
-			return r
 		}
 		if v, ok := n["VAR?"]; ok {
 			return GetVar{
-				Name: v.(string),
+				Name: l.string(path+".VAR?", v),
 			}
 		}
 		if v, ok := n["CNT?"]; ok {
 			return GetVisitCount{
-				Container: v.(string),
+				Container: l.string(path+".CNT?", v),
 			}
 		}
 		if v, ok := n["f()"]; ok {
-			r := FuncCall{
-				Dest: Address(v.(string)),
+			return FuncCall{
+				Dest: Address(l.string(path+".f()", v)),
+				Var:  l.optBool(path, n, "var"),
+			}
+		}
+		if v, ok := n["x()"]; ok {
+			var args int
+			if exArgs, ok := n["exArgs"]; ok {
+				args = l.int(path+".exArgs", exArgs)
 			}
-			if v, ok := n["var"]; ok {
-				r.Var = v.(bool)
+			return ExternalCall{
+				Name: l.string(path+".x()", v),
+				Args: args,
 			}
-			return r
 		}
 		if v, ok := n["->t->"]; ok {
-			r := TunnelCall{
-				Dest: Address(v.(string)),
+			return TunnelCall{
+				Dest: Address(l.string(path+".->t->", v)),
+				Var:  l.optBool(path, n, "var"),
 			}
-			if v, ok := n["var"]; ok {
-				r.Var = v.(bool)
-			}
-			return r
 		}
 		if v, ok := n["^var"]; ok {
-			ci, err := n["ci"].(json.Number).Int64()
-			if err != nil {
-				panic(err)
+			ci, ok := n["ci"]
+			if !ok {
+				l.errorf(path, "variable reference is missing \"ci\"")
 			}
 			return VarRef{
-				Name:         v.(string),
-				ContentIndex: int(ci),
+				Name:         l.string(path+".^var", v),
+				ContentIndex: l.int(path+".ci", ci),
 			}
 		}
 		if v, ok := n["list"]; ok {
-			list := ListValue{
-				Origins: make(map[string]struct{}),
+			return l.list(path, v, n["origins"])
+		}
+		l.errorf(path, "unsupported object with keys %q", slices.Sorted(maps.Keys(n)))
+		return nil
+	case []any:
+		return l.container(path, n)
+	}
+	l.errorf(path, "unsupported node %s", jsonType(n))
+	return nil
+}
+
+func (l *loader) list(path string, items, origins any) ListValue {
+	list := ListValue{
+		Origins: make(map[string]struct{}),
+	}
+	put := func(k string, v any) {
+		i := l.int(path+".list."+k, v)
+		origin, name, ok := strings.Cut(k, ".")
+		if !ok {
+			l.errorf(path+".list."+k, "list item must be qualified with its list name")
+			return
+		}
+		list = list.Put(origin, name, i)
+	}
+	switch m := items.(type) {
+	case jsonObject:
+		// the items are kept in the order they were added to the list
+		for _, f := range m {
+			put(f.Key, f.Value)
+		}
+	case map[string]any:
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			put(k, m[k])
+		}
+		// the order of the items in the JSON is lost, so they're kept sorted
+		list = list.sorted()
+	default:
+		l.errorf(path+".list", "expected an object, found %s", jsonType(items))
+		return list
+	}
+	if origins == nil {
+		return list
+	}
+	o, ok := origins.([]any)
+	if !ok {
+		l.errorf(path+".origins", "expected an array, found %s", jsonType(origins))
+		return list
+	}
+	for i, origin := range o {
+		list.Origins[l.string(fmt.Sprintf("%s.origins.%d", path, i), origin)] = struct{}{}
+	}
+	return list
+}
+
+// jsonObject is a JSON object with its keys in the order they were written.
+// The items of a list are saved this way, since LIST_RANDOM depends on the
+// order they were added to the list.
+type jsonObject []jsonField
+
+type jsonField struct {
+	Key   string
+	Value any
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// decodeValue decodes the next value like a json.Decoder with UseNumber,
+// except that the items of a list are decoded as a jsonObject.
+func decodeValue(dec *json.Decoder, ordered bool) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('['):
+		a := []any{}
+		for dec.More() {
+			v, err := decodeValue(dec, false)
+			if err != nil {
+				return nil, err
 			}
-			for k, vv := range v.(map[string]any) {
-				i, err := vv.(json.Number).Int64()
-				if err != nil {
-					panic(err)
-				}
-				origin, name, ok := strings.Cut(k, ".")
-				if !ok {
-					panic(fmt.Errorf("unsupported list item: %q", k))
-				}
-				list = list.Put(origin, name, int(i))
+			a = append(a, v)
+		}
+		_, err := dec.Token()
+		return a, err
+	case json.Delim('{'):
+		var o jsonObject
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
 			}
-			if origins := n["origins"]; origins != nil {
-				for _, origin := range origins.([]any) {
-					list.Origins[origin.(string)] = struct{}{}
-				}
+			k := tok.(string)
+			v, err := decodeValue(dec, k == "list")
+			if err != nil {
+				return nil, err
 			}
-			return list
+			o = append(o, jsonField{Key: k, Value: v})
 		}
-		panic(fmt.Errorf("unsupported node: %#v", n))
-	case []any:
-		return LoadContainer(n)
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		if ordered {
+			return o, nil
+		}
+		m := make(map[string]any, len(o))
+		for _, f := range o {
+			m[f.Key] = f.Value
+		}
+		return m, nil
 	}
-	panic(fmt.Errorf("unsupported node: %#v", n))
+	return tok, nil
 }
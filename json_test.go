@@ -1,10 +1,13 @@
 package gouache
 
 import (
+	"bytes"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadJSON(t *testing.T) {
@@ -17,3 +20,75 @@ func TestLoadJSON(t *testing.T) {
 	el, _ := c.Find("0.c-0")
 	assert.Equal(t, BeginEval{}, el.Node())
 }
+
+func TestLoadJSONProblems(t *testing.T) {
+	_, _, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [
+			[
+				"^hello",
+				"bogus",
+				{"*": "0.c-0"},
+				{"^var": "x", "ci": 1.5},
+				{"->": "0.c-0", "c": "yes"},
+				null
+			],
+			"done",
+			{
+				"tavern": ["^x", {"list": {"missing-dot": 1}}, null],
+				"#f": "1",
+				"cellar": "not a container"
+			}
+		],
+		"listDefs": {"a": {"b": "1"}}
+	}`))
+	var lerr *LoadError
+	require.ErrorAs(t, err, &lerr)
+	// the problems are in a consistent order, with the metadata of each
+	// container sorted by key
+	assert.Equal(t, []LoadProblem{
+		{Path: "root.#f", Message: `expected an integer, found string "1"`},
+		{Path: "root.cellar", Message: `expected a container, found string "not a container"`},
+		{Path: "root.tavern.1.list.missing-dot", Message: "list item must be qualified with its list name"},
+		{Path: "root.0.1", Message: `unsupported control command "bogus"`},
+		{Path: "root.0.2", Message: `choice point is missing "flg"`},
+		{Path: "root.0.2.flg", Message: "expected an integer, found null"},
+		{Path: "root.0.3.ci", Message: "expected an integer, found 1.5"},
+		{Path: "root.0.4.c", Message: `expected a bool, found string "yes"`},
+		{Path: "listDefs.a.b", Message: `expected an integer, found string "1"`},
+	}, lerr.Problems)
+}
+
+func TestLoadJSONEmptyContainer(t *testing.T) {
+	_, _, err := LoadJSON(strings.NewReader(`{"inkVersion": 21, "root": [[], null]}`))
+	var lerr *LoadError
+	require.ErrorAs(t, err, &lerr)
+	assert.Equal(t, []LoadProblem{
+		{Path: "root.0", Message: "container must end with a metadata element"},
+	}, lerr.Problems)
+	assert.EqualError(t, err, "invalid story: root.0: container must end with a metadata element")
+}
+
+func FuzzLoadJSON(f *testing.F) {
+	for _, name := range samples {
+		b, err := os.ReadFile("./testdata/" + name + ".ink.json")
+		require.NoError(f, err)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// only checking that loading doesn't panic
+		LoadJSON(bytes.NewReader(b))
+	})
+}
+
+func TestLoadContainer(t *testing.T) {
+	contents := []any{[]any{"^hi", nil}, nil}
+	c, err := ParseContainer(contents)
+	require.NoError(t, err)
+	assert.Equal(t, c, LoadContainer(contents))
+
+	_, err = ParseContainer([]any{[]any{}, nil})
+	var lerr *LoadError
+	require.ErrorAs(t, err, &lerr)
+	assert.PanicsWithError(t, err.Error(), func() { LoadContainer([]any{[]any{}, nil}) })
+}
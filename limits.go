@@ -0,0 +1,66 @@
+package gouache
+
+import "errors"
+
+// ErrLimitExceeded is wrapped by the errors from a story going past one of
+// its Limits.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// Limits bounds the work a story can do, so that a story stuck in a loop or
+// recursing without end fails with an error, rather than hanging or running
+// out of memory. A limit of zero is unlimited.
+type Limits struct {
+	// MaxSteps is the number of elements each call to Continue or
+	// ContinueLine can run.
+	MaxSteps int
+	// MaxCallDepth is the number of nested function and tunnel calls.
+	MaxCallDepth int
+	// MaxEvalStack is the number of values on the evaluation stack.
+	MaxEvalStack int
+	// MaxOutput is the length in bytes of the text from each call to Continue
+	// or ContinueLine.
+	MaxOutput int
+}
+
+// SetLimits sets the limits on the work done by the story.
+func (s *Story) SetLimits(limits Limits) {
+	s.limits = limits
+	se := s.eval.(StepEvaluator)
+	se.Stack = se.Stack.withLimits(limits)
+	s.eval = se
+}
+
+// checkLimits returns a *RuntimeError at the element just run, once a call
+// has run too many steps or produced too much output, like the errors for the
+// limits checked while running the story.
+func (s *Story) checkLimits(el Element, steps, output int) error {
+	if s.limits.MaxSteps > 0 && steps > s.limits.MaxSteps {
+		return newRuntimeError(stepLimitError(s.limits), el, s.eval)
+	}
+	if s.limits.MaxOutput > 0 && output > s.limits.MaxOutput {
+		return newRuntimeError(inkErrorf("%w: more than %d bytes of output", ErrLimitExceeded, s.limits.MaxOutput), el, s.eval)
+	}
+	return nil
+}
+
+func stepLimitError(limits Limits) inkError {
+	return inkErrorf("%w: more than %d steps", ErrLimitExceeded, limits.MaxSteps)
+}
+
+func (f *CallFrame) withLimits(limits Limits) *CallFrame {
+	r := *f
+	r.limits = limits
+	return &r
+}
+
+func (f *CallFrame) checkCallDepth() {
+	if f.limits.MaxCallDepth > 0 && f.callDepth > f.limits.MaxCallDepth {
+		panic(inkErrorf("%w: call depth is more than %d", ErrLimitExceeded, f.limits.MaxCallDepth))
+	}
+}
+
+func (f *CallFrame) checkEvalStack() {
+	if f.limits.MaxEvalStack > 0 && f.evalStack.Len() > f.limits.MaxEvalStack {
+		panic(inkErrorf("%w: eval stack has more than %d values", ErrLimitExceeded, f.limits.MaxEvalStack))
+	}
+}
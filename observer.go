@@ -0,0 +1,102 @@
+package gouache
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// VariableObserver is called when the value of a global variable changes.
+type VariableObserver func(name string, old, new Value)
+
+type varChange struct {
+	name     string
+	old, new Value
+}
+
+// ObserveVariable calls fn whenever the story changes the global variable.
+// Observers are called for each assignment that changed the variable, in the
+// order they were made, so a variable that is set and then set back is seen
+// twice. When the observers are batched, they're called once per call to
+// Continue with the net change, so a variable that ends up back at its
+// starting value isn't seen at all. Either way, they're called once the call
+// to Continue succeeds, so they don't see the changes made by steps that are
+// undone after an error.
+func (s *Story) ObserveVariable(name string, fn VariableObserver) error {
+	if _, ok := s.globals.Get(name); !ok {
+		return fmt.Errorf("cannot observe variable %q which isn't declared in the story", name)
+	}
+	if s.observers == nil {
+		s.observers = make(map[string][]VariableObserver)
+	}
+	s.observers[name] = append(s.observers[name], fn)
+	return nil
+}
+
+// SetBatchObservers sets whether the variable observers are called once at the
+// end of each call to Continue or ContinueLine with the final value of each
+// variable that changed, rather than for each assignment to it.
+func (s *Story) SetBatchObservers(batch bool) {
+	s.batchObservers = batch
+}
+
+func (s *Story) globalVars() *Vars {
+	return s.eval.(StepEvaluator).Stack.globals
+}
+
+// observe adds the changes to the globals since before to the batch, to notify
+// the observers once the call succeeds.
+func (s *Story) observe(before *Vars, batch *[]varChange) {
+	if len(s.observers) == 0 {
+		return
+	}
+	*batch = append(*batch, globalChanges(before, s.globalVars())...)
+}
+
+// flushObservers notifies the observers of the changes in the batch, combining
+// the changes to each variable if the observers are batched.
+func (s *Story) flushObservers(batch []varChange) {
+	if !s.batchObservers {
+		s.notify(batch)
+		return
+	}
+	var merged []varChange
+	for _, c := range batch {
+		i := slices.IndexFunc(merged, func(m varChange) bool { return m.name == c.name })
+		if i == -1 {
+			merged = append(merged, c)
+		} else {
+			merged[i].new = c.new
+		}
+	}
+	s.notify(merged)
+}
+
+func (s *Story) notify(changes []varChange) {
+	for _, c := range changes {
+		if reflect.DeepEqual(c.old, c.new) {
+			continue
+		}
+		for _, fn := range s.observers[c.name] {
+			fn(c.name, c.old, c.new)
+		}
+	}
+}
+
+// globalChanges returns the assignments made to the globals since before, in
+// the order they were made. Assignments are added to the front of the globals,
+// so these are the ones ahead of before.
+func globalChanges(before, after *Vars) []varChange {
+	var changes []varChange
+	v := after
+	for ; v != before && v != nil; v = v.prev {
+		old, _ := v.prev.Get(v.name)
+		changes = append(changes, varChange{name: v.name, old: old, new: v.value})
+	}
+	if v != before {
+		// the globals were replaced rather than assigned
+		return nil
+	}
+	slices.Reverse(changes)
+	return changes
+}
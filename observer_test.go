@@ -0,0 +1,131 @@
+package gouache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordChanges observes the variables, recording each change as a string.
+func recordChanges(t *testing.T, story *Story, names ...string) *[]string {
+	t.Helper()
+	var changes []string
+	for _, name := range names {
+		require.NoError(t, story.ObserveVariable(name, func(name string, old, new Value) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, old, new))
+		}))
+	}
+	return &changes
+}
+
+func TestObserveVariable(t *testing.T) {
+	container, listDefs := load(t, "./testdata/observe.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	changes := recordChanges(t, story, "gold", "health")
+	mustContinue(t, story)
+	// assigning health the same value doesn't notify the observer
+	assert.Equal(t, []string{
+		"gold: 0 -> 5",
+		"gold: 5 -> 10",
+		"health: 10 -> 7",
+		"health: 7 -> 6",
+	}, *changes)
+}
+
+func TestObserveVariableBatched(t *testing.T) {
+	container, listDefs := load(t, "./testdata/observe.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	story.SetBatchObservers(true)
+	changes := recordChanges(t, story, "gold", "health")
+	mustContinue(t, story)
+	assert.Equal(t, []string{
+		"gold: 0 -> 10",
+		"health: 10 -> 6",
+	}, *changes)
+}
+
+func TestObserveVariableSetBack(t *testing.T) {
+	// ~ gold = 5
+	// ~ gold = 0
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [[
+			"ev", 5, "/ev", {"VAR=": "gold", "re": true},
+			"ev", 0, "/ev", {"VAR=": "gold", "re": true},
+			"^Done.", "\n", "done", null
+		], "done", {"global decl": ["ev", 0, {"VAR=": "gold"}, "/ev", "end", null]}],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+
+	// each assignment is observed, even though the value ends where it started
+	story := mustNewStory(t, container, listDefs)
+	changes := recordChanges(t, story, "gold")
+	mustContinue(t, story)
+	assert.Equal(t, []string{"gold: 0 -> 5", "gold: 5 -> 0"}, *changes)
+
+	// batched observers only see the net change, which is none
+	story = mustNewStory(t, container, listDefs)
+	story.SetBatchObservers(true)
+	changes = recordChanges(t, story, "gold")
+	mustContinue(t, story)
+	assert.Empty(t, *changes)
+}
+
+func TestObserveVariableByLine(t *testing.T) {
+	for _, tc := range []struct {
+		batch bool
+	}{
+		{false},
+		{true},
+	} {
+		t.Run(fmt.Sprint("batch=", tc.batch), func(t *testing.T) {
+			container, listDefs := load(t, "./testdata/observe.ink.json")
+			story := mustNewStory(t, container, listDefs)
+			story.SetBatchObservers(tc.batch)
+			changes := recordChanges(t, story, "gold")
+			// looking ahead for the end of the line reaches the next assignment,
+			// but it's rewound, so it's only observed with the next line
+			assert.Equal(t, "You find some gold.\n", mustContinueLine(t, story))
+			assert.Equal(t, []string{"gold: 0 -> 5"}, *changes)
+			gold, err := story.Variables().GetInt("gold")
+			require.NoError(t, err)
+			assert.Equal(t, 5, gold)
+			assert.Equal(t, "More gold.\n", mustContinueLine(t, story))
+			assert.Equal(t, []string{"gold: 0 -> 5", "gold: 5 -> 10"}, *changes)
+			gold, err = story.Variables().GetInt("gold")
+			require.NoError(t, err)
+			assert.Equal(t, 10, gold)
+		})
+	}
+}
+
+func TestObserveUndeclaredVariable(t *testing.T) {
+	container, listDefs := load(t, "./testdata/observe.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Error(t, story.ObserveVariable("mana", func(name string, old, new Value) {}))
+}
+
+func TestObserveVariableError(t *testing.T) {
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [[
+			"ev", 5, "/ev", {"VAR=": "gold", "re": true},
+			"ev", {"VAR?": "missing"}, "out", "/ev", "done", null
+		], "done", {"global decl": ["ev", 0, {"VAR=": "gold"}, "/ev", "end", null]}],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+	changes := recordChanges(t, story, "gold")
+	// the story is rewound after the error, so the change is never seen
+	_, err = story.Continue()
+	require.Error(t, err)
+	assert.Empty(t, *changes)
+	gold, err := story.Variables().GetInt("gold")
+	require.NoError(t, err)
+	assert.Equal(t, 0, gold)
+}
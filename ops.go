@@ -1,15 +1,9 @@
 package gouache
 
-import "fmt"
-
 func (n Divert) GetDest(el Element, stack *CallFrame) (Element, *CallFrame) {
 	addr := n.Dest
 	if n.Var {
-		addrVar, ok := stack.GetVar(string(addr))
-		if !ok {
-			panic(fmt.Errorf("address variable %q not found", addr))
-		}
-		addr = addrVar.(DivertTargetValue).Dest
+		addr = divertTarget(stack, string(addr))
 	}
 	if n.Conditional {
 		var cond Value
@@ -20,7 +14,7 @@ func (n Divert) GetDest(el Element, stack *CallFrame) (Element, *CallFrame) {
 	}
 	dest, visitAddr := el.Find(addr)
 	if dest == nil {
-		panic(fmt.Errorf("divert target %q not found", n.Dest))
+		panic(inkErrorf("divert target %q not found", n.Dest))
 	}
 	from, _ := el.Address()
 	stack = visit(from, visitAddr, stack)
@@ -36,7 +30,7 @@ func (n DupTop) Apply(stack *CallFrame) *CallFrame {
 func (n GetVar) Apply(stack *CallFrame) *CallFrame {
 	val, ok := stack.GetVar(n.Name)
 	if !ok {
-		panic(fmt.Errorf("variable %q not found", n.Name))
+		panic(inkErrorf("variable %q not found", n.Name))
 	}
 	return stack.PushVal(val)
 }
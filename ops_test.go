@@ -0,0 +1,86 @@
+package gouache
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinOpCoercion(t *testing.T) {
+	a := ListSingle("letters", "a", 1)
+	b := ListSingle("letters", "b", 2)
+	knot := DivertTargetValue{Dest: "knot"}
+	cases := []struct {
+		name     string
+		op       BinOp
+		a, b     Value
+		expected Value
+	}{
+		{"int lt float", Lt, IntValue(1), FloatValue(1.5), BoolValue(true)},
+		{"float gt int", Gt, FloatValue(1.5), IntValue(1), BoolValue(true)},
+		{"bool plus int", Add, BoolValue(true), IntValue(2), IntValue(3)},
+		{"bool plus float", Add, BoolValue(true), FloatValue(0.5), FloatValue(1.5)},
+		{"bool eq bool", Eq, BoolValue(true), BoolValue(true), BoolValue(true)},
+		{"int eq float", Eq, IntValue(2), FloatValue(2), BoolValue(true)},
+		{"int concat string", Add, IntValue(1), StringValue("a"), StringValue("1a")},
+		{"string eq int", Eq, StringValue("1"), IntValue(1), BoolValue(true)},
+		{"string has", Has, StringValue("hello"), StringValue("ell"), BoolValue(true)},
+		{"list eq", Eq, a, ListSingle("letters", "a", 1), BoolValue(true)},
+		{"list ne", Ne, a, b, BoolValue(true)},
+		{"list eq in any order", Eq, Add(b, a), Add(a, b), BoolValue(true)},
+		{"list gte", Gte, b, a, BoolValue(true)},
+		{"list plus int", Add, a, IntValue(1), ListValue{Items: []ListItem{{Origin: "letters", Value: 2}}}},
+		{"list eq int", Eq, a, IntValue(1), BoolValue(true)},
+		{"list ne int", Ne, a, IntValue(2), BoolValue(true)},
+		{"int lt list", Lt, IntValue(1), b, BoolValue(true)},
+		{"list gte int", Gte, b, IntValue(3), BoolValue(false)},
+		{"list has int", Has, Add(a, b), IntValue(2), BoolValue(true)},
+		{"list and int", And, a, IntValue(0), BoolValue(false)},
+		{"list or int", Or, ListValue{}, IntValue(1), BoolValue(true)},
+		{"divert eq", Eq, knot, DivertTargetValue{Dest: "knot"}, BoolValue(true)},
+		{"divert ne", Ne, knot, DivertTargetValue{Dest: "other"}, BoolValue(true)},
+		{"float div zero", Div, FloatValue(1), IntValue(0), FloatValue(math.Inf(1))},
+		{"int min float", Min, IntValue(1), FloatValue(2), FloatValue(1)},
+		{"int pow int", Pow, IntValue(2), IntValue(-1), FloatValue(0.5)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.op(tc.a, tc.b))
+		})
+	}
+}
+
+func TestBinOpErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		op   BinOp
+		a, b Value
+		err  string
+	}{
+		{"int div zero", Div, IntValue(1), IntValue(0), "attempted to divide by zero"},
+		{"int mod zero", Mod, IntValue(1), BoolValue(false), "attempted to divide by zero"},
+		{"string sub", Sub, StringValue("a"), IntValue(1), "cannot perform operation '-' on String"},
+		{"divert lt", Lt, DivertTargetValue{Dest: "a"}, DivertTargetValue{Dest: "b"}, "cannot perform operation '<' on DivertTarget"},
+		{"divert eq int", Eq, DivertTargetValue{Dest: "a"}, IntValue(1), "cannot convert Int to DivertTarget"},
+		{"empty list eq int", Eq, ListEmpty("letters"), IntValue(1), "cannot convert Int to List, since the list is empty"},
+		{"int plus list", Add, IntValue(1), ListSingle("letters", "a", 1), "cannot perform operation '+' on Int and List"},
+		{"void", Add, VoidValue{}, IntValue(1), "attempting to perform operation on a void value, did you forget to 'return' a value from a function you called here?"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.PanicsWithError(t, tc.err, func() { tc.op(tc.a, tc.b) })
+		})
+	}
+}
+
+func TestUnaryOpCoercion(t *testing.T) {
+	assert.Equal(t, IntValue(-1), Neg(BoolValue(true)))
+	assert.Equal(t, BoolValue(true), Not(FloatValue(0)))
+	assert.Equal(t, IntValue(1), Not(ListValue{}))
+	assert.Equal(t, FloatValue(1), Float(BoolValue(true)))
+	assert.Equal(t, IntValue(2), Int(FloatValue(2.7)))
+	assert.PanicsWithError(t, "cannot perform operation '_' on String", func() {
+		Neg(StringValue("a"))
+	})
+}
@@ -0,0 +1,89 @@
+package gouache
+
+import "math"
+
+// netRandom generates the same sequence of numbers as .NET's System.Random,
+// which the reference runtime uses for RANDOM and shuffle sequences, so that
+// seeded stories give the same results.
+type netRandom struct {
+	seeds         [56]int32
+	inext, inextp int
+}
+
+func newNetRandom(seed int32) *netRandom {
+	const mseed = 161803398
+	subtraction := seed
+	if seed == math.MinInt32 {
+		subtraction = math.MaxInt32
+	} else if seed < 0 {
+		subtraction = -seed
+	}
+	r := &netRandom{inextp: 21}
+	mj := mseed - subtraction
+	r.seeds[55] = mj
+	mk := int32(1)
+	for i := 1; i < 55; i++ {
+		ii := (21 * i) % 55
+		r.seeds[ii] = mk
+		mk = mj - mk
+		if mk < 0 {
+			mk += math.MaxInt32
+		}
+		mj = r.seeds[ii]
+	}
+	for range 4 {
+		for i := 1; i < 56; i++ {
+			r.seeds[i] -= r.seeds[1+(i+30)%55]
+			if r.seeds[i] < 0 {
+				r.seeds[i] += math.MaxInt32
+			}
+		}
+	}
+	return r
+}
+
+// Next returns a non-negative number less than math.MaxInt32.
+func (r *netRandom) Next() int32 {
+	r.inext++
+	if r.inext >= 56 {
+		r.inext = 1
+	}
+	r.inextp++
+	if r.inextp >= 56 {
+		r.inextp = 1
+	}
+	v := r.seeds[r.inext] - r.seeds[r.inextp]
+	if v == math.MaxInt32 {
+		v--
+	}
+	if v < 0 {
+		v += math.MaxInt32
+	}
+	r.seeds[r.inext] = v
+	return v
+}
+
+// shuffle returns the index of the element to use for a shuffle sequence,
+// given the number of times the sequence has been visited. Each loop through
+// the sequence picks the elements in a different order, seeded from the path
+// of the sequence, the loop and the story's seed.
+func shuffle(container string, elements, seqCount int, storySeed int64) int {
+	var hash int32
+	for _, c := range container {
+		hash += c
+	}
+	loop := int32(seqCount / elements)
+	r := newNetRandom(hash + loop + int32(storySeed))
+	unpicked := make([]int, elements)
+	for i := range unpicked {
+		unpicked[i] = i
+	}
+	for i := 0; ; i++ {
+		chosen := int(r.Next()) % len(unpicked)
+		index := unpicked[chosen]
+		if i == seqCount%elements {
+			return index
+		}
+		unpicked = append(unpicked[:chosen], unpicked[chosen+1:]...)
+	}
+}
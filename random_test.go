@@ -0,0 +1,25 @@
+package gouache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetRandom(t *testing.T) {
+	// known values from .NET's System.Random
+	for _, tc := range []struct {
+		seed int32
+		want []int32
+	}{
+		{0, []int32{1559595546, 1755192844, 1649316166}},
+		{42, []int32{1434747710, 302596119, 269548474}},
+	} {
+		r := newNetRandom(tc.seed)
+		var got []int32
+		for range tc.want {
+			got = append(got, r.Next())
+		}
+		assert.Equal(t, tc.want, got, "seed %d", tc.seed)
+	}
+}
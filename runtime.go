@@ -1,7 +1,7 @@
 package gouache
 
 import (
-	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/mgood/gouache/glue"
@@ -19,6 +19,7 @@ type Outputter interface {
 
 type Choice struct {
 	Label              string
+	Tags               []string
 	Dest               Element
 	Eval               Evaluator
 	IsInvisibleDefault bool
@@ -43,43 +44,78 @@ type StepEvaluator struct {
 func (e StepEvaluator) Step(el Element) (Output, *Choice, Element, Evaluator) {
 	switch el.Node().(type) {
 	case End:
-		// FIXME end is supposed to unwind the full stack
-		return "", nil, nil, StepEvaluator{Stack: e.Stack, Stepper: BaseEvaluator{}}
+		// end the flow, unwinding any functions, tunnels and threads
+		return "", nil, nil, StepEvaluator{Stack: e.Stack.resetCallstack(), Stepper: BaseEvaluator{}}
+	case Done:
+		stack, ret, stepper := e.Stack.PopThread()
+		if stack == nil {
+			// in the outermost thread the flow stops here, but it can be resumed by
+			// choosing a choice or a path
+			return "", nil, nil, StepEvaluator{Stack: e.Stack, Stepper: BaseEvaluator{}}
+		}
+		if ret == nil {
+			// the thread was started at the end of its container, so the thread
+			// it was forked from has run out of content too
+			return runOut("", nil, stack, stepper)
+		}
+		next, stack := visitNext(ret, stack)
+		return "", nil, next, StepEvaluator{Stack: stack, Stepper: stepper}
 	}
 	stack := e.Stack
 	out, choice, elem, stack, stepper := e.Stepper.Step(stack, el)
 	if choice != nil {
-		choiceStack := stack.ResetChoiceCount()
+		choiceStack := stack.ResetChoiceCount().detachThread()
 		if !choice.IsInvisibleDefault {
 			choiceStack = choiceStack.IncTurnCount()
 		}
 		choice.Eval = StepEvaluator{Stack: choiceStack, Stepper: stepper}
 	}
 	if elem == nil {
-		var nextStepper Stepper
-		var isFunction bool
-		stack, elem, nextStepper, isFunction = stack.PopFrame()
-		if nextStepper == nil {
-			nextStepper = BaseEvaluator{}
-		} else if sw, ok := stepper.(StringWrappedEvaluator); ok {
-			// If we were capturing the output, restore capturing
-			// of the output to the previous frame.
-			// Maybe the output capture should go into the stack instead?
-			sw.wrapped = nextStepper
-			if isFunction {
-				sw.output += string(glue.FuncEnd)
-			}
-			stepper = sw
-		} else {
-			stepper = nextStepper
-			if isFunction {
-				out += Output(glue.FuncEnd)
-			}
+		return runOut(out, choice, stack, stepper)
+	}
+	return out, choice, elem, StepEvaluator{Stack: stack, Stepper: stepper}
+}
+
+// runOut continues once the current container has run out of content, in the
+// thread, function or tunnel which it returns to.
+func runOut(out Output, choice *Choice, stack *CallFrame, stepper Stepper) (Output, *Choice, Element, Evaluator) {
+	if !stack.isFunction && stack.thread != nil {
+		// running out of content finishes a thread, the same as DONE
+		var ret Element
+		stack, ret, stepper = stack.PopThread()
+		if ret == nil {
+			return runOut(out, choice, stack, stepper)
 		}
-		stack = stack.PushVal(VoidValue{})
-		if elem != nil {
-			elem, stack = visitNext(elem, stack)
+		elem, stack := visitNext(ret, stack)
+		return out, choice, elem, StepEvaluator{Stack: stack, Stepper: stepper}
+	}
+	var elem Element
+	var nextStepper Stepper
+	var isFunction bool
+	stack, elem, nextStepper, isFunction = stack.PopFrame()
+	if nextStepper == nil {
+		nextStepper = BaseEvaluator{}
+	} else if sw, ok := stepper.(StringWrappedEvaluator); ok {
+		// If we were capturing the output, restore capturing
+		// of the output to the previous frame.
+		// Maybe the output capture should go into the stack instead?
+		sw.wrapped = nextStepper
+		if isFunction {
+			sw.output += string(glue.FuncEnd)
 		}
+		stepper = sw
+	} else {
+		stepper = nextStepper
+		if isFunction {
+			out += Output(glue.FuncEnd)
+		}
+	}
+	if isFunction {
+		// a function without an explicit return evaluates to void
+		stack = stack.PushVal(VoidValue{})
+	}
+	if elem != nil {
+		elem, stack = visitNext(elem, stack)
 	}
 	return out, choice, elem, StepEvaluator{Stack: stack, Stepper: stepper}
 }
@@ -88,27 +124,25 @@ type Stepper interface {
 	Step(*CallFrame, Element) (Output, *Choice, Element, *CallFrame, Stepper)
 }
 
+// Init evaluates the global declarations and returns the start of the story.
+// Like Continue, it panics if the story fails, whereas NewStory and the Story
+// methods return the failure as an error.
 func Init(c Container, listDefs ListDefs) (Element, Evaluator) {
+	return initWithOptions(c, listDefs, Options{})
+}
+
+// initWithOptions is Init, with the global declarations run with the options.
+func initWithOptions(c Container, listDefs ListDefs, opts Options) (Element, Evaluator) {
+	limits := opts.Limits
 	var eval Evaluator = StepEvaluator{
 		Stack: &CallFrame{
-			listDefs: listDefs,
+			storyState: storyState{listDefs: listDefs, limits: limits, compat: opts.Compatibility},
 		},
 		Stepper: BaseEvaluator{},
 	}
 	if g, _ := c.Find("global decl"); g != nil {
-		var s Output
-		var choice *Choice
-		elem := g
-		for ; ; s, choice, elem, eval = eval.Step(elem) {
-			if s.String() != "" {
-				panic(fmt.Errorf("unexpected output while initializing globals %q", s))
-			}
-			if choice != nil {
-				panic(fmt.Errorf("unexpected choice while initializing globals %#v", choice))
-			}
-			if elem == nil {
-				break
-			}
+		for elem, steps := g, 0; elem != nil; steps++ {
+			elem, eval = initStep(elem, eval, steps, limits)
 		}
 	}
 	// FIXME we should be able to initialize the visit state from any starting
@@ -116,9 +150,34 @@ func Init(c Container, listDefs ListDefs) (Element, Evaluator) {
 	root, visitAddrs := c.atNoFlatten(0).Flatten()
 	se := eval.(StepEvaluator)
 	se.Stack = visit("", visitAddrs, se.Stack)
+	if root == nil {
+		// an empty root container has nothing to continue
+		return nil, se
+	}
 	return root, se
 }
 
+// initStep runs an element of the global declarations. A failure panics with
+// a *RuntimeError at the element, like the errors from running the story.
+func initStep(el Element, eval Evaluator, steps int, limits Limits) (Element, Evaluator) {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(inkError{newRuntimeError(r, el, eval)})
+		}
+	}()
+	if limits.MaxSteps > 0 && steps >= limits.MaxSteps {
+		panic(stepLimitError(limits))
+	}
+	s, choice, next, nextEval := eval.Step(el)
+	if s.String() != "" {
+		panic(inkErrorf("unexpected output while initializing globals %q", s))
+	}
+	if choice != nil {
+		panic(inkErrorf("unexpected choice while initializing globals %#v", choice))
+	}
+	return next, nextEval
+}
+
 func Continue(output glue.StringWriter, eval Evaluator, elem Element) []Choice {
 	var choices []Choice
 	var defaultChoice *Choice
@@ -134,6 +193,10 @@ func Continue(output glue.StringWriter, eval Evaluator, elem Element) []Choice {
 			}
 		}
 		if elem != nil {
+			if _, ok := elem.Node().(End); ok {
+				// the choices generated so far are dropped at the end of the story
+				choices, defaultChoice = nil, nil
+			}
 			continue
 		}
 		if len(choices) == 0 && defaultChoice != nil {
@@ -207,6 +270,7 @@ func (e BaseEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		return "", nil, next, stack, TagEvaluator{Prev: e}
 	case ChoicePoint:
 		var label StringValue
+		var tags []string
 		enabled := true
 		if n.Flags&HasCondition != 0 {
 			var cond Value
@@ -217,14 +281,19 @@ func (e BaseEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 			var x StringValue
 			x, stack = pop[StringValue](stack)
 			label = x
+			tags, stack = popTags(stack, tags)
 		}
 		if n.Flags&HasStartContent != 0 {
 			var x StringValue
 			x, stack = pop[StringValue](stack)
 			label = x + label
+			tags, stack = popTags(stack, tags)
 		}
 		if n.Flags&OnceOnly != 0 {
 			dest, _ := el.Find(n.Dest)
+			if dest == nil {
+				panic(inkErrorf("choice target %q not found", n.Dest))
+			}
 			addr, _ := dest.Address()
 			visits := stack.VisitCount(addr)
 			if visits != 0 {
@@ -241,6 +310,7 @@ func (e BaseEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		}
 		choice := &Choice{
 			Label:              string(label),
+			Tags:               tags,
 			Dest:               choiceElement{node: dest, src: el},
 			IsInvisibleDefault: isInvisibleDefault,
 		}
@@ -259,39 +329,37 @@ func (e BaseEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 	case FuncReturn:
 		stack, ret, eval, isFunction := stack.PopFrame()
 		if !isFunction {
-			panic(fmt.Errorf("unexpected function return"))
+			panic(inkErrorf("unexpected function return"))
 		}
 		ret, stack = visitNext(ret, stack)
 		return Output(glue.FuncEnd), nil, ret, stack, eval
 	case TunnelCall:
 		addr := n.Dest
 		if n.Var {
-			addrVar, ok := stack.GetVar(string(addr))
-			if !ok {
-				panic(fmt.Errorf("address variable %q not found", addr))
-			}
-			addr = addrVar.(DivertTargetValue).Dest
+			addr = divertTarget(stack, string(addr))
 		}
 		dest, visitAddr := el.Find(addr)
 		if dest == nil {
-			panic(fmt.Errorf("tunnel call target %q not found", n.Dest))
+			panic(inkErrorf("tunnel call target %q not found", n.Dest))
 		}
 		stack = stack.PushFrame(el, e, false)
 		from, _ := el.Address()
 		stack = visit(from, visitAddr, stack)
 		return "", nil, dest, stack, e
 	case ThreadStart:
+		// the new thread runs the divert which follows, and when it's done, the
+		// current thread continues after the divert
 		next, stack := visitNext(el, stack)
-		stack = stack.PushFrame(next, e, false)
+		stack = stack.ForkThread(next, e)
 		return "", nil, next, stack, e
 	case TunnelReturn:
 		rv, stack := stack.PopVal()
 		stack, ret, eval, isFunction := stack.PopFrame()
 		if isFunction {
-			panic(fmt.Errorf("unexpected tunnel return in function"))
+			panic(inkErrorf("unexpected tunnel return in function"))
 		}
 		if ret == nil {
-			panic(fmt.Errorf("Found tunnel onwards ->-> but no tunnel to return to"))
+			panic(inkErrorf("Found tunnel onwards ->-> but no tunnel to return to"))
 		}
 		switch rv := rv.(type) {
 		case VoidValue:
@@ -299,7 +367,7 @@ func (e BaseEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		case DivertTargetValue:
 			ret, _ = el.Find(rv.Dest)
 		default:
-			panic(fmt.Errorf("unexpected tunnel return value %T", rv))
+			panic(inkErrorf("unexpected tunnel return value %T", rv))
 		}
 		return "", nil, ret, stack, eval
 	case NoOp:
@@ -311,13 +379,11 @@ func (e BaseEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		return "", nil, next, stack, e
 	case Out:
 		val, stack := stack.PopVal()
-		o := val.(Outputter).Output()
+		o := stack.output(val)
 		next, stack := visitNext(el, stack)
 		return o, nil, next, stack, e
-	case Done:
-		return "", nil, nil, stack, e
 	default:
-		panic(fmt.Errorf("unexpected node type %T", n))
+		panic(inkErrorf("unexpected node type %T", n))
 	}
 }
 
@@ -344,7 +410,38 @@ func (e choiceElement) Next() (Element, []VisitAddr) {
 
 func pop[T any](s *CallFrame) (T, *CallFrame) {
 	val, s := s.PopVal()
-	return val.(T), s
+	t, ok := val.(T)
+	if !ok {
+		panic(inkErrorf("expected %T on the eval stack, found %T", t, val))
+	}
+	return t, s
+}
+
+// divertTarget returns the target of a divert to the address in a variable.
+func divertTarget(stack *CallFrame, name string) Address {
+	v, ok := stack.GetVar(name)
+	if !ok {
+		panic(inkErrorf("address variable %q not found", name))
+	}
+	t, ok := v.(DivertTargetValue)
+	if !ok {
+		panic(inkErrorf("expected a divert target in %q, found %T", name, v))
+	}
+	return t.Dest
+}
+
+// popTags pops the tags from the choice text that were evaluated before the
+// text itself, and prepends them to the tags already popped.
+func popTags(s *CallFrame, tags []string) ([]string, *CallFrame) {
+	var popped []string
+	for {
+		tag, ok := s.PeekVal().(TagValue)
+		if !ok {
+			return append(popped, tags...), s
+		}
+		_, s = s.PopVal()
+		popped = append([]string{string(tag)}, popped...)
+	}
 }
 
 type EvalEvaluator struct {
@@ -362,7 +459,7 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 	case GetVar:
 		val, ok := stack.GetVar(n.Name)
 		if !ok {
-			panic(fmt.Errorf("variable %q not found", n.Name))
+			panic(inkErrorf("variable %q not found", n.Name))
 		}
 		stack = stack.PushVal(val)
 		next, stack := visitNext(el, stack)
@@ -376,7 +473,12 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
 	case DivertTargetValue, IntValue, FloatValue, BoolValue, ListValue:
-		stack = stack.PushVal(n)
+		if stack.compat {
+			// the reference runtime loads numbers as 32-bit ints and floats
+			stack = stack.PushVal(compatValue(n))
+		} else {
+			stack = stack.PushVal(n)
+		}
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
 	case Text:
@@ -386,12 +488,21 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 	case BinOp:
 		b, stack := stack.PopVal()
 		a, stack := stack.PopVal()
-		stack = stack.PushVal(n(a, b))
+		if stack.compat {
+			a, b = compatOperands(a, b)
+			stack = stack.PushVal(compatValue(n(a, b)))
+		} else {
+			stack = stack.PushVal(n(a, b))
+		}
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
 	case UnaryOp:
 		a, stack := stack.PopVal()
-		stack = stack.PushVal(n(a))
+		if stack.compat {
+			stack = stack.PushVal(compatValue(n(compatValue(a))))
+		} else {
+			stack = stack.PushVal(n(a))
+		}
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
 	case Pop:
@@ -404,20 +515,26 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 	case FuncCall:
 		addr := n.Dest
 		if n.Var {
-			addrVar, ok := stack.GetVar(string(addr))
-			if !ok {
-				panic(fmt.Errorf("address variable %q not found", addr))
-			}
-			addr = addrVar.(DivertTargetValue).Dest
+			addr = divertTarget(stack, string(addr))
 		}
 		dest, visitAddrs := el.Find(addr)
 		if dest == nil {
-			panic(fmt.Errorf("function call target %q not found", n.Dest))
+			panic(inkErrorf("function call target %q not found", n.Dest))
 		}
-		from, _ := el.Address()
-		stack = visit(from, visitAddrs, stack)
-		stack = stack.PushFrame(el, e, true)
-		return Output(glue.FuncStart), nil, dest, stack, BaseEvaluator{}
+		return e.callFunction(stack, el, dest, visitAddrs)
+	case ExternalCall:
+		fn, ok := stack.externals[n.Name]
+		if !ok {
+			// fall back to an ink function with the same name
+			dest, visitAddrs := el.Find(Address(n.Name))
+			if dest == nil {
+				panic(inkErrorf("external function %q is not bound", n.Name))
+			}
+			return e.callFunction(stack, el, dest, visitAddrs)
+		}
+		stack = fn.call(stack, n)
+		next, stack := visitNext(el, stack)
+		return "", nil, next, stack, e
 	case TurnCounter:
 		turn := IntValue(stack.turnCount)
 		stack = stack.PushVal(turn)
@@ -456,7 +573,7 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		return "", nil, next, stack, e
 	case Out:
 		val, stack := stack.PopVal()
-		o := val.(Outputter).Output()
+		o := stack.output(val)
 		next, stack := visitNext(el, stack)
 		return o, nil, next, stack, e
 	case Void:
@@ -468,9 +585,9 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
 	case ListInt:
-		val, stack := stack.PopVal()
-		origin, stack := stack.PopVal()
-		v := stack.ListInt(string(origin.(StringValue)), int(val.(IntValue)))
+		val, stack := pop[IntValue](stack)
+		origin, stack := pop[StringValue](stack)
+		v := stack.ListInt(string(origin), int(val))
 		stack = stack.PushVal(v)
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
@@ -526,6 +643,19 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 		stack = stack.PushVal(val.Range(start, end))
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
+	case ListRandomFunc:
+		val, stack := pop[ListValue](stack)
+		if len(val.Items) > 0 {
+			// the item is picked with the story's random numbers, like RANDOM,
+			// from the items in the order they were added to the list
+			var r int64
+			r, stack = stack.NextRandom()
+			item := val.insertionOrder()[r%int64(len(val.Items))]
+			val = ListSingle(item.Origin, item.Name, item.Value)
+		}
+		stack = stack.PushVal(val)
+		next, stack := visitNext(el, stack)
+		return "", nil, next, stack, e
 	case ListIntersectFunc:
 		a, stack := pop[ListValue](stack)
 		b, stack := pop[ListValue](stack)
@@ -544,16 +674,47 @@ func (e EvalEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Elem
 	case Seq:
 		elements, stack := pop[IntValue](stack)
 		seqCount, stack := pop[IntValue](stack)
+		if elements <= 0 {
+			panic(inkErrorf("shuffle sequence has %d elements", elements))
+		}
+		if seqCount < 0 {
+			panic(inkErrorf("shuffle sequence count is negative: %d", seqCount))
+		}
 		addr, _ := el.Address()
-		index := shuffle(string(addr), int(elements), int(seqCount))
+		index := shuffle(string(addr), int(elements), int(seqCount), stack.storySeed)
 		stack = stack.PushVal(IntValue(index))
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
+	case Random:
+		hi, stack := pop[IntValue](stack)
+		lo, stack := pop[IntValue](stack)
+		if hi < lo {
+			panic(inkErrorf("RANDOM was called with minimum as %d and maximum as %d. The maximum must be larger", lo, hi))
+		}
+		r, stack := stack.NextRandom()
+		stack = stack.PushVal(lo + IntValue(r%int64(hi-lo+1)))
+		next, stack := visitNext(el, stack)
+		return "", nil, next, stack, e
+	case SeedRandom:
+		seed, stack := pop[IntValue](stack)
+		stack = stack.SeedRandom(int64(seed))
+		stack = stack.PushVal(VoidValue{})
+		next, stack := visitNext(el, stack)
+		return "", nil, next, stack, e
 	default:
-		panic(fmt.Errorf("unexpected node type %T", n))
+		panic(inkErrorf("unexpected node type %T", n))
 	}
 }
 
+// callFunction pushes a frame for a function call, which returns to the
+// current element and evaluator.
+func (e EvalEvaluator) callFunction(stack *CallFrame, el, dest Element, visitAddrs []VisitAddr) (Output, *Choice, Element, *CallFrame, Stepper) {
+	from, _ := el.Address()
+	stack = visit(from, visitAddrs, stack)
+	stack = stack.PushFrame(el, e, true)
+	return Output(glue.FuncStart), nil, dest, stack, BaseEvaluator{}
+}
+
 func resolve(base, addr Address) Address {
 	if addr == ".^" {
 		return base
@@ -576,8 +737,10 @@ func resolve(base, addr Address) Address {
 }
 
 type StringEvaluator struct {
-	output string
-	Prev   Stepper
+	output   string
+	tags     []string
+	afterTag bool
+	Prev     Stepper
 }
 
 func (e StringEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Element, *CallFrame, Stepper) {
@@ -602,22 +765,71 @@ func (e StringEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, El
 		dest, stack := n.GetDest(el, stack)
 		return "", nil, dest, stack, e
 	case EndStringEval:
-		stack = stack.PushVal(StringValue(glue.StripInline(e.output)))
 		next, stack := visitNext(el, stack)
+		if len(e.tags) > 0 && isChoiceLabel(next) {
+			// tags in the choice text are pushed to the stack to be picked up by
+			// the choice point
+			for _, tag := range e.tags {
+				stack = stack.PushVal(TagValue(tag))
+			}
+		}
+		stack = stack.PushVal(StringValue(glue.StripInline(e.output)))
 		return "", nil, next, stack, e.Prev
 	case BeginTag:
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, TagEvaluator{Prev: e}
 	default:
-		panic(fmt.Errorf("unexpected node type %T", n))
+		panic(inkErrorf("unexpected node type %T", n))
 	}
 }
 
 func (e StringEvaluator) pushText(s string) StringEvaluator {
+	if e.afterTag {
+		// the tag took the place of the space that separated it from the text
+		s = strings.TrimLeft(s, " \t")
+		e.afterTag = s == ""
+	}
 	e.output += s
 	return e
 }
 
+// pushTag adds a tag from the text, trimming the space that separated it.
+func (e StringEvaluator) pushTag(tag string) StringEvaluator {
+	e.output = strings.TrimRight(e.output, " \t")
+	e.tags = append(slices.Clip(e.tags), tag)
+	e.afterTag = true
+	return e
+}
+
+// isChoiceLabel reports whether el follows the text of a choice, in which case
+// the rest of the eval block is followed by the choice point.
+func isChoiceLabel(el Element) bool {
+	for el != nil {
+		if _, ok := el.Node().(EndEval); ok {
+			next, _ := el.Next()
+			if next == nil {
+				return false
+			}
+			_, ok := next.Node().(ChoicePoint)
+			return ok
+		}
+		el, _ = el.Next()
+	}
+	return false
+}
+
+func (e StringEvaluator) setOutput(s string) Stepper {
+	e.output = s
+	return e
+}
+
+// outputCapturer is a Stepper which accumulates output, such as the output of
+// an eval block wrapped by StringWrappedEvaluator.
+type outputCapturer interface {
+	Stepper
+	setOutput(string) Stepper
+}
+
 type StringWrappedEvaluator struct {
 	wrapped Stepper
 	output  string
@@ -636,11 +848,13 @@ func (e StringWrappedEvaluator) Step(stack *CallFrame, el Element) (Output, *Cho
 		e.output += s
 	}
 	if e.depth < 0 {
-		// once eval stack ends, we expect to be back at the prior string evaluator
-		// so we set its accumulated output and then return there
-		streval := eval.(StringEvaluator)
-		streval.output = e.output
-		eval = streval
+		// once eval stack ends, we expect to be back at the prior string or tag
+		// evaluator so we set its accumulated output and then return there
+		oc, ok := eval.(outputCapturer)
+		if !ok {
+			panic(inkErrorf("unexpected end of evaluation outside of a string or tag"))
+		}
+		eval = oc.setOutput(e.output)
 	} else {
 		e.wrapped = eval
 		eval = e
@@ -649,20 +863,54 @@ func (e StringWrappedEvaluator) Step(stack *CallFrame, el Element) (Output, *Cho
 }
 
 type TagEvaluator struct {
-	Prev Stepper
+	output string
+	Prev   Stepper
 }
 
 func (e TagEvaluator) Step(stack *CallFrame, el Element) (Output, *Choice, Element, *CallFrame, Stepper) {
 	switch n := el.Node().(type) {
 	case Text:
-		// TODO store tags on the previous output?
-		// or maybe buffer tags until we reach a Newline{}
+		e.output += string(n)
 		next, stack := visitNext(el, stack)
 		return "", nil, next, stack, e
+	case NoOp:
+		next, stack := visitNext(el, stack)
+		return "", nil, next, stack, e
+	case Pop:
+		_, stack = stack.PopVal()
+		next, stack := visitNext(el, stack)
+		return "", nil, next, stack, e
+	case BeginEval:
+		// dynamic tags evaluate expressions and capture their output
+		next, stack := visitNext(el, stack)
+		return "", nil, next, stack, StringWrappedEvaluator{
+			output:  e.output,
+			wrapped: EvalEvaluator{Prev: e},
+		}
+	case Divert:
+		dest, stack := n.GetDest(el, stack)
+		return "", nil, dest, stack, e
 	case EndTag:
 		next, stack := visitNext(el, stack)
-		return "", nil, next, stack, e.Prev
+		if e.output == "" {
+			return "", nil, next, stack, e.Prev
+		}
+		if prev, ok := e.Prev.(StringEvaluator); ok {
+			// tags in string text are kept by the string, rather than being output
+			return "", nil, next, stack, prev.pushTag(e.tagText())
+		}
+		return Output(string(glue.TagStart) + e.tagText() + string(glue.TagEnd)), nil, next, stack, e.Prev
 	default:
-		panic(fmt.Errorf("unexpected node type %T", n))
+		panic(inkErrorf("unexpected node type %T", n))
 	}
 }
+
+func (e TagEvaluator) setOutput(s string) Stepper {
+	e.output = s
+	return e
+}
+
+// tagText returns the tag text with the whitespace cleaned up.
+func (e TagEvaluator) tagText() string {
+	return strings.Join(strings.Fields(glue.StripInline(e.output)), " ")
+}
@@ -1,7 +1,6 @@
 package gouache
 
 import (
-	"fmt"
 	"strings"
 )
 
@@ -10,6 +9,17 @@ type Visit struct {
 	IsVisit   bool
 	EntryTurn int
 	Prev      *Visit
+	// count is the number of visits the entry stands for, so that the counts
+	// loaded from a save take one entry each. Zero is the same as one.
+	count int
+}
+
+// visits is the number of visits the entry records.
+func (v *Visit) visits() int {
+	if !v.IsVisit {
+		return 0
+	}
+	return max(v.count, 1)
 }
 
 func (v *Visit) Push(addr VisitAddr, from Address, turn int) *Visit {
@@ -41,8 +51,8 @@ func (v *Visit) Push(addr VisitAddr, from Address, turn int) *Visit {
 func (v *Visit) Count(addr Address) int {
 	var count int
 	for ; v != nil; v = v.Prev {
-		if v.IsVisit && addr == v.Address {
-			count++
+		if addr == v.Address {
+			count += v.visits()
 		}
 	}
 	return count
@@ -117,16 +127,29 @@ func (v *Vars) Get(name string) (Value, bool) {
 type EvalFrame struct {
 	value Value
 	prev  *EvalFrame
+	size  int
 }
 
 func (f *EvalFrame) Push(v Value) *EvalFrame {
 	return &EvalFrame{
 		value: v,
 		prev:  f,
+		size:  f.Len() + 1,
+	}
+}
+
+// Len returns the number of values on the stack.
+func (f *EvalFrame) Len() int {
+	if f == nil {
+		return 0
 	}
+	return f.size
 }
 
 func (f *EvalFrame) Pop() (Value, *EvalFrame) {
+	if f == nil {
+		panic(inkErrorf("eval stack is empty"))
+	}
 	return f.value, f.prev
 }
 
@@ -152,6 +175,15 @@ func (li ListItem) Add(v Value) Value {
 	}
 }
 
+// same reports whether the items are the same, where an item without a name,
+// such as an int converted to a list, matches by its origin and value.
+func (li ListItem) same(x ListItem) bool {
+	if li.Name != "" && x.Name != "" && li.Name != x.Name {
+		return false
+	}
+	return li.Origin == x.Origin && li.Value == x.Value
+}
+
 func (li ListItem) Output() Output {
 	return Output(li.Name)
 }
@@ -167,7 +199,7 @@ func (l ListDefs) All(origin string) ListValue {
 	for name, v := range o {
 		r = r.Add(ListSingle(origin, name, v))
 	}
-	return r
+	return r.sorted()
 }
 
 func (l ListDefs) Value(origin string, value int) ListValue {
@@ -202,13 +234,45 @@ func (l ListDefs) Get(name string) (ListValue, bool) {
 	return ListValue{}, false
 }
 
+// threadFork is the thread that a thread was forked from with "<-", which
+// continues from the element after the thread start once the thread is done.
+type threadFork struct {
+	stack    *CallFrame
+	returnTo Element
+	retStep  Stepper
+}
+
+// storyState is the state shared by every flow of a story, along with the
+// definitions provided by the host.
+type storyState struct {
+	visits    *Visit
+	turnCount int
+	globals   *Vars
+	listDefs  ListDefs
+	externals map[string]ExternalFunction
+
+	// each random number is generated from the seed and the previous random
+	// number, as in the reference runtime, so the position in the sequence can
+	// be saved and restored
+	storySeed      int64
+	previousRandom int64
+
+	// compat follows the number semantics of the reference runtime
+	compat bool
+	limits Limits
+}
+
+// CallFrame is a frame of the callstack of a flow. Frames are never modified,
+// so the rest of the state of the flow is kept in each frame, and the
+// innermost frame's is the current state.
 type CallFrame struct {
-	visits      *Visit
-	turnCount   int
+	storyState
 	choiceCount int
-	globals     *Vars
 	evalStack   *EvalFrame
-	listDefs    ListDefs
+
+	// thread is the thread this one was forked from, or nil in the outermost
+	// thread. As with the shared state, only the innermost frame's is used.
+	thread *threadFork
 
 	locals     *Vars
 	callDepth  int
@@ -286,14 +350,16 @@ func (f *CallFrame) ListAll(v ListValue) ListValue {
 	for origin := range v.Origins {
 		r = r.Add(f.listDefs.All(origin))
 	}
-	return r
+	return r.sorted()
 }
 
 func (f *CallFrame) PushVal(v Value) *CallFrame {
 	if li, ok := v.(ListValue); ok {
 		v = li.Resolve(f.listDefs)
 	}
-	return f.updateEvalStack(func(s *EvalFrame) *EvalFrame { return s.Push(v) })
+	f = f.updateEvalStack(func(s *EvalFrame) *EvalFrame { return s.Push(v) })
+	f.checkEvalStack()
+	return f
 }
 
 func (f *CallFrame) PopVal() (Value, *CallFrame) {
@@ -305,15 +371,42 @@ func (f *CallFrame) PopVal() (Value, *CallFrame) {
 	return v, f
 }
 
+// PeekVal returns the value on top of the eval stack without removing it, or
+// nil if the stack is empty.
+func (f *CallFrame) PeekVal() Value {
+	if f == nil || f.evalStack == nil {
+		return nil
+	}
+	return f.evalStack.value
+}
+
 func (f *CallFrame) IncTurnCount() *CallFrame {
 	if f == nil {
-		return &CallFrame{turnCount: 1}
+		return &CallFrame{storyState: storyState{turnCount: 1}}
 	}
 	r := *f
 	r.turnCount++
 	return &r
 }
 
+// NextRandom returns the next number in the story's sequence of random
+// numbers.
+func (f *CallFrame) NextRandom() (int64, *CallFrame) {
+	// the seed wraps around like the reference runtime's 32-bit ints
+	src := newNetRandom(int32(f.storySeed) + int32(f.previousRandom))
+	r := *f
+	r.previousRandom = int64(src.Next())
+	return r.previousRandom, &r
+}
+
+// SeedRandom restarts the story's sequence of random numbers from a seed.
+func (f *CallFrame) SeedRandom(seed int64) *CallFrame {
+	r := *f
+	r.storySeed = seed
+	r.previousRandom = 0
+	return &r
+}
+
 func (f *CallFrame) setRef(ref VarRef, v Value) *CallFrame {
 	// if this is a nested reference, we need to find the deepest location to
 	// update
@@ -369,7 +462,7 @@ func (f *CallFrame) PushVarRef(name string) *CallFrame {
 	if _, isGlobal := f.globals.Get(name); isGlobal {
 		return f.PushVal(VarRef{Name: name, ContentIndex: 0})
 	}
-	panic(fmt.Errorf("variable %s not found", name))
+	panic(inkErrorf("variable %s not found", name))
 }
 
 func (f *CallFrame) PushFrame(returnTo Element, retStep Stepper, isFunction bool) *CallFrame {
@@ -377,33 +470,43 @@ func (f *CallFrame) PushFrame(returnTo Element, retStep Stepper, isFunction bool
 		return &CallFrame{}
 	}
 	r := &CallFrame{
-		prev:        f,
-		returnTo:    returnTo,
-		retStep:     retStep,
-		visits:      f.visits,
-		turnCount:   f.turnCount,
+		storyState:  f.storyState,
 		choiceCount: f.choiceCount,
-		globals:     f.globals,
-		callDepth:   f.callDepth + 1,
-		isFunction:  isFunction,
 		evalStack:   f.evalStack,
-		listDefs:    f.listDefs,
+		thread:      f.thread,
+
+		prev:       f,
+		returnTo:   returnTo,
+		retStep:    retStep,
+		callDepth:  f.callDepth + 1,
+		isFunction: isFunction,
 	}
+	r.checkCallDepth()
 	return r
 }
 
+// CallStack returns the paths of the elements that each frame returns to,
+// starting from the innermost frame.
+func (f *CallFrame) CallStack() []Address {
+	var addrs []Address
+	for ; f != nil; f = f.prev {
+		if f.returnTo != nil {
+			addrs = append(addrs, elementPath(f.returnTo.Address()))
+		}
+	}
+	return addrs
+}
+
 func (f *CallFrame) PopFrame() (*CallFrame, Element, Stepper, bool) {
 	p := f.prev
 	if p == nil {
 		p = &CallFrame{}
 	}
 	return &CallFrame{
-		visits:      f.visits,
-		turnCount:   f.turnCount,
+		storyState:  f.storyState,
 		choiceCount: f.choiceCount,
-		globals:     f.globals,
 		evalStack:   f.evalStack,
-		listDefs:    f.listDefs,
+		thread:      f.thread,
 
 		callDepth:  p.callDepth,
 		locals:     p.locals,
@@ -414,24 +517,67 @@ func (f *CallFrame) PopFrame() (*CallFrame, Element, Stepper, bool) {
 	}, f.returnTo, f.retStep, f.isFunction
 }
 
+// ForkThread starts a new thread with a copy of the callstack. When the new
+// thread is done, the current thread continues from returnTo.
+func (f *CallFrame) ForkThread(returnTo Element, retStep Stepper) *CallFrame {
+	r := *f
+	r.thread = &threadFork{stack: f, returnTo: returnTo, retStep: retStep}
+	return &r
+}
+
+// PopThread ends the current thread, returning the thread it was forked from
+// and where that thread continues, or nil if this is the outermost thread.
+func (f *CallFrame) PopThread() (*CallFrame, Element, Stepper) {
+	t := f.thread
+	if t == nil {
+		return nil, nil, nil
+	}
+	r := t.stack.withShared(f)
+	r.choiceCount = f.choiceCount
+	return r, t.returnTo, t.retStep
+}
+
+// detachThread returns the callstack of the current thread on its own, as kept
+// by a choice generated in the thread. Once the choice is taken, the thread
+// becomes the only one, so finishing it ends the flow.
+func (f *CallFrame) detachThread() *CallFrame {
+	if f.thread == nil {
+		return f
+	}
+	r := *f
+	r.thread = nil
+	return &r
+}
+
+// WithGlobal sets a global variable. Setting a global that wasn't declared
+// isn't an error, but the story reports it as a warning.
 func (f *CallFrame) WithGlobal(name string, value Value) *CallFrame {
-	// TODO globals should be declared at start?
-	// check for setting an undeclared global?
 	return f.withGlobals(f.globals.With(name, value))
 }
 
+// hasVar reports whether a local or global variable has been declared.
+func (f *CallFrame) hasVar(name string) bool {
+	if f.locals != nil {
+		if _, ok := f.locals.Get(name); ok {
+			return true
+		}
+	}
+	_, ok := f.globals.Get(name)
+	return ok
+}
+
 func (f *CallFrame) getRef(r VarRef) Value {
 	if r.ContentIndex == 0 {
 		v, ok := f.globals.Get(r.Name)
 		if !ok {
-			panic(fmt.Errorf("global %s not found", r.Name))
+			panic(inkErrorf("global %s not found", r.Name))
 		}
 		return v
 	}
 	if r.ContentIndex == f.callDepth+1 {
 		v, ok := f.locals.Get(r.Name)
 		if !ok {
-			panic(fmt.Errorf("local %s not found", r.Name))
+			panic(inkErrorf("local %s not found", r.Name))
 		}
 		return v
 	}
@@ -493,9 +639,49 @@ func (f *CallFrame) GetVar(name string) (Value, bool) {
 	return f.listDefs.Get(name)
 }
 
+// withStoryState returns the frame with the state of the story replaced, as
+// when switching to another flow.
+func (f *CallFrame) withStoryState(state storyState) *CallFrame {
+	r := *f
+	r.storyState = state
+	return &r
+}
+
+// withShared returns the frame with the story state and the eval stack, which
+// are shared by every thread of the flow, copied from another frame.
+func (f *CallFrame) withShared(from *CallFrame) *CallFrame {
+	r := f.withStoryState(from.storyState)
+	r.evalStack = from.evalStack
+	return r
+}
+
+func (f *CallFrame) withEvalStack(s *EvalFrame) *CallFrame {
+	r := *f
+	r.evalStack = s
+	return &r
+}
+
+// resetCallstack returns a frame with the state shared by the whole flow, but
+// without the frames for any functions, tunnels or threads.
+func (f *CallFrame) resetCallstack() *CallFrame {
+	return (&CallFrame{}).withShared(f)
+}
+
+func (f *CallFrame) withExternals(externals map[string]ExternalFunction) *CallFrame {
+	r := *f
+	r.externals = externals
+	return &r
+}
+
+func (f *CallFrame) withCompat(compat bool) *CallFrame {
+	r := *f
+	r.compat = compat
+	return &r
+}
+
 func (f *CallFrame) withGlobals(v *Vars) *CallFrame {
 	if f == nil {
-		return &CallFrame{globals: v}
+		return &CallFrame{storyState: storyState{globals: v}}
 	}
 	r := *f
 	r.globals = v
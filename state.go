@@ -0,0 +1,727 @@
+package gouache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mgood/gouache/glue"
+)
+
+const (
+	// InkSaveVersion is the version of the save format written by SaveState.
+	InkSaveVersion = 10
+	// MinInkSaveVersion is the oldest save format that LoadState can read.
+	MinInkSaveVersion = 8
+)
+
+// The types of callstack frames in the save format.
+const (
+	pushPopTunnel = iota
+	pushPopFunction
+	pushPopFunctionEvaluationFromGame
+)
+
+// StateError lists all of the problems found while loading a saved state.
+type StateError struct {
+	Problems []LoadProblem
+}
+
+func (e *StateError) Error() string {
+	return formatProblems("invalid save state", e.Problems)
+}
+
+// saveState is the JSON structure of the save format used by the reference
+// runtime's StoryState.ToJson.
+type saveState struct {
+	Flows           map[string]flowState `json:"flows,omitempty"`
+	CurrentFlowName string               `json:"currentFlowName,omitempty"`
+
+	// Before version 10 the default flow was saved at the top level.
+	CallstackThreads *callstackState        `json:"callstackThreads,omitempty"`
+	OutputStream     []any                  `json:"outputStream,omitempty"`
+	ChoiceThreads    map[string]threadState `json:"choiceThreads,omitempty"`
+	CurrentChoices   []choiceState          `json:"currentChoices,omitempty"`
+
+	VariablesState   savedVars      `json:"variablesState"`
+	EvalStack        savedValues    `json:"evalStack"`
+	VisitCounts      map[string]int `json:"visitCounts"`
+	TurnIndices      map[string]int `json:"turnIndices"`
+	TurnIdx          int            `json:"turnIdx"`
+	StorySeed        int64          `json:"storySeed"`
+	PreviousRandom   int64          `json:"previousRandom"`
+	InkSaveVersion   int            `json:"inkSaveVersion"`
+	InkFormatVersion int            `json:"inkFormatVersion"`
+}
+
+type flowState struct {
+	Callstack      callstackState         `json:"callstack"`
+	OutputStream   []any                  `json:"outputStream"`
+	ChoiceThreads  map[string]threadState `json:"choiceThreads,omitempty"`
+	CurrentChoices []choiceState          `json:"currentChoices"`
+	// Ended isn't in the reference runtime's format, which doesn't tell END
+	// apart from DONE, and is ignored by it.
+	Ended bool `json:"ended,omitempty"`
+}
+
+type callstackState struct {
+	Threads       []threadState `json:"threads"`
+	ThreadCounter int           `json:"threadCounter"`
+}
+
+type threadState struct {
+	Callstack             []frameState `json:"callstack"`
+	ThreadIndex           int          `json:"threadIndex"`
+	PreviousContentObject string       `json:"previousContentObject,omitempty"`
+}
+
+type frameState struct {
+	CPath *string   `json:"cPath,omitempty"`
+	Idx   *int      `json:"idx,omitempty"`
+	Exp   bool      `json:"exp"`
+	Type  int       `json:"type"`
+	Temp  savedVars `json:"temp,omitempty"`
+}
+
+// savedVars and savedValues hold the values in a save, which are decoded with
+// the items of lists kept in order.
+type (
+	savedVars   map[string]any
+	savedValues []any
+)
+
+func (v *savedVars) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*v = nil
+		return nil
+	}
+	*v = make(savedVars, len(raw))
+	for name, r := range raw {
+		val, err := decodeSavedValue(r)
+		if err != nil {
+			return err
+		}
+		(*v)[name] = val
+	}
+	return nil
+}
+
+func (v *savedValues) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*v = nil
+		return nil
+	}
+	*v = make(savedValues, len(raw))
+	for i, r := range raw {
+		val, err := decodeSavedValue(r)
+		if err != nil {
+			return err
+		}
+		(*v)[i] = val
+	}
+	return nil
+}
+
+func decodeSavedValue(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return decodeValue(dec, false)
+}
+
+type choiceState struct {
+	Text                string   `json:"text"`
+	Index               int      `json:"index"`
+	OriginalChoicePath  string   `json:"originalChoicePath"`
+	OriginalThreadIndex int      `json:"originalThreadIndex"`
+	TargetPath          string   `json:"targetPath"`
+	Tags                []string `json:"tags,omitempty"`
+}
+
+// SaveState writes the state of the story as JSON, in the same format as the
+// reference runtime's StoryState.ToJson, so that it can be restored later with
+// LoadState.
+func (s *Story) SaveState(w io.Writer) error {
+	if err := s.checkNotPending("save the state"); err != nil {
+		return err
+	}
+	state, err := s.saveState()
+	if err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(state)
+}
+
+func (s *Story) saveState() (*saveState, error) {
+	stack := s.eval.(StepEvaluator).Stack
+	flows := make(map[string]flowState)
+	for _, name := range slices.Sorted(maps.Keys(s.flows)) {
+		snap := s.flows[name]
+		if snap.eval.(StepEvaluator).Stack.evalStack != nil {
+			// the save format only has the eval stack of the current flow
+			return nil, fmt.Errorf("flow %q has values on the eval stack", name)
+		}
+		flow, err := saveFlow(snap)
+		if err != nil {
+			return nil, fmt.Errorf("flow %q: %w", name, err)
+		}
+		flows[name] = flow
+	}
+	flow, err := saveFlow(s.snapshot())
+	if err != nil {
+		return nil, err
+	}
+	flows[s.flowName] = flow
+
+	globals, err := saveVars(stack.globals)
+	if err != nil {
+		return nil, err
+	}
+	evalStack := []any{}
+	var values []Value
+	for f := stack.evalStack; f != nil; f = f.prev {
+		values = append(values, f.value)
+	}
+	slices.Reverse(values)
+	for _, v := range values {
+		j, err := saveValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("eval stack: %w", err)
+		}
+		evalStack = append(evalStack, j)
+	}
+
+	visitCounts := make(map[string]int)
+	turnIndices := make(map[string]int)
+	for v := stack.visits; v != nil; v = v.Prev {
+		addr := string(v.Address)
+		if v.IsVisit {
+			visitCounts[addr] += v.visits()
+		}
+		if _, ok := turnIndices[addr]; !ok {
+			// the reference runtime counts turns from -1 rather than 0
+			turnIndices[addr] = v.EntryTurn - 1
+		}
+	}
+
+	return &saveState{
+		Flows:            flows,
+		CurrentFlowName:  s.flowName,
+		VariablesState:   globals,
+		EvalStack:        evalStack,
+		VisitCounts:      visitCounts,
+		TurnIndices:      turnIndices,
+		TurnIdx:          stack.turnCount - 1,
+		StorySeed:        stack.storySeed,
+		PreviousRandom:   stack.previousRandom,
+		InkSaveVersion:   InkSaveVersion,
+		InkFormatVersion: MaxInkVersion,
+	}, nil
+}
+
+// saveFlow saves the callstack, output and choices of a flow.
+func saveFlow(snap snapshot) (flowState, error) {
+	se := snap.eval.(StepEvaluator)
+	stack := se.Stack
+
+	// a tag in progress is saved in the output stream, as the reference runtime
+	// does while it checks whether the tag belongs to the current line
+	outputStream := []any{}
+	stepper := se.Stepper
+	if tag, ok := stepper.(TagEvaluator); ok {
+		outputStream = append(outputStream, "#", "^"+glue.StripInline(tag.output))
+		stepper = tag.Prev
+	}
+	// the threads that the current thread was forked from are saved before it,
+	// each positioned at the divert that started the next thread
+	var forks []*threadFork
+	for t := stack.thread; t != nil; t = t.stack.thread {
+		forks = append(forks, t)
+	}
+	slices.Reverse(forks)
+	flow := flowState{
+		OutputStream:   outputStream,
+		CurrentChoices: []choiceState{},
+		Ended:          snap.ended,
+	}
+	for i, t := range forks {
+		thread, err := saveThread(t.stack, t.returnTo, t.retStep, i)
+		if err != nil {
+			return flow, err
+		}
+		flow.Callstack.Threads = append(flow.Callstack.Threads, thread)
+	}
+	thread, err := saveThread(stack, snap.elem, stepper, len(forks))
+	if err != nil {
+		return flow, err
+	}
+	flow.Callstack.Threads = append(flow.Callstack.Threads, thread)
+	flow.Callstack.ThreadCounter = len(forks)
+	for i, choice := range visibleChoices(snap.choices) {
+		src := choice.Dest.(choiceElement).src
+		base, _ := src.Address()
+		// each choice keeps the callstack from where it was generated, so it's
+		// saved as a separate thread
+		index := len(forks) + i + 1
+		ce := choice.Eval.(StepEvaluator)
+		t, err := saveThread(ce.Stack, src, ce.Stepper, index)
+		if err != nil {
+			return flow, fmt.Errorf("choice %d: %w", i, err)
+		}
+		if flow.ChoiceThreads == nil {
+			flow.ChoiceThreads = make(map[string]threadState)
+		}
+		flow.ChoiceThreads[strconv.Itoa(index)] = t
+		flow.Callstack.ThreadCounter = index
+		flow.CurrentChoices = append(flow.CurrentChoices, choiceState{
+			Text:                choice.Label,
+			Index:               i,
+			OriginalChoicePath:  string(elementPath(src.Address())),
+			OriginalThreadIndex: index,
+			TargetPath:          string(resolve(base, choice.Dest.Node().(Divert).Dest)),
+			Tags:                choice.Tags,
+		})
+	}
+	return flow, nil
+}
+
+// saveThread saves the frames of the callstack, from the outermost frame. The
+// position of each frame is the element that the next frame returns to, and
+// for the innermost frame it's the current element.
+func saveThread(stack *CallFrame, top Element, stepper Stepper, index int) (threadState, error) {
+	var frames []*CallFrame
+	for f := stack; f != nil; f = f.prev {
+		frames = append(frames, f)
+	}
+	slices.Reverse(frames)
+	t := threadState{
+		Callstack:   make([]frameState, 0, len(frames)),
+		ThreadIndex: index,
+	}
+	for i, f := range frames {
+		el, st := top, stepper
+		if i+1 < len(frames) {
+			el, st = frames[i+1].returnTo, frames[i+1].retStep
+		}
+		exp, err := inExpression(st)
+		if err != nil {
+			return t, err
+		}
+		temp, err := saveVars(f.locals)
+		if err != nil {
+			return t, err
+		}
+		fs := frameState{
+			Exp:  exp,
+			Type: pushPopTunnel,
+			Temp: temp,
+		}
+		if i > 0 && f.isFunction {
+			fs.Type = pushPopFunction
+		}
+		if el != nil {
+			addr, idx := el.Address()
+			fs.CPath = ptr(string(addr))
+			fs.Idx = ptr(idx)
+		}
+		t.Callstack = append(t.Callstack, fs)
+	}
+	return t, nil
+}
+
+// inExpression reports whether the stepper is evaluating an expression. The
+// save format can't represent a string being evaluated, which only happens
+// partway through a step.
+func inExpression(st Stepper) (bool, error) {
+	switch st := st.(type) {
+	case nil, BaseEvaluator:
+		return false, nil
+	case EvalEvaluator:
+		if _, ok := st.Prev.(BaseEvaluator); ok {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("cannot save while evaluating %T", st)
+}
+
+func saveVars(v *Vars) (map[string]any, error) {
+	m := make(map[string]any)
+	for ; v != nil; v = v.prev {
+		if _, ok := m[v.name]; ok {
+			continue
+		}
+		j, err := saveValue(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("variable %q: %w", v.name, err)
+		}
+		m[v.name] = j
+	}
+	return m, nil
+}
+
+func saveValue(v Value) (any, error) {
+	switch v := v.(type) {
+	case IntValue:
+		return json.Number(strconv.FormatInt(int64(v), 10)), nil
+	case FloatValue:
+		f := float64(v)
+		switch {
+		case math.IsNaN(f):
+			return json.Number("0.0"), nil
+		case math.IsInf(f, 0):
+			// JSON can't represent infinity, so the reference runtime saves the
+			// largest float32 instead
+			return json.Number(strconv.FormatFloat(math.Copysign(3.4e38, f), 'E', -1, 64)), nil
+		}
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			// make sure it's loaded as a float
+			s += ".0"
+		}
+		return json.Number(s), nil
+	case BoolValue:
+		return bool(v), nil
+	case StringValue:
+		if v == "\n" {
+			return "\n", nil
+		}
+		return "^" + string(v), nil
+	case DivertTargetValue:
+		return map[string]any{"^->": string(v.Dest)}, nil
+	case VarRef:
+		return map[string]any{"^var": v.Name, "ci": v.ContentIndex}, nil
+	case ListValue:
+		// like the reference runtime, the items are saved in the order they
+		// were added to the list
+		var items jsonObject
+		for _, item := range v.insertionOrder() {
+			items = append(items, jsonField{Key: item.Origin + "." + item.Name, Value: item.Value})
+		}
+		m := map[string]any{"list": items}
+		if len(v.Items) == 0 && len(v.Origins) > 0 {
+			m["origins"] = slices.Sorted(maps.Keys(v.Origins))
+		}
+		return m, nil
+	case VoidValue:
+		return "void", nil
+	case TagValue:
+		return map[string]any{"#": string(v)}, nil
+	}
+	return nil, fmt.Errorf("cannot save value of type %T", v)
+}
+
+// LoadState restores the state of the story from JSON written by SaveState,
+// or by the reference runtime for the same story. Any problems with the state
+// are returned as a *StateError, and the story is left unchanged.
+func (s *Story) LoadState(r io.Reader) error {
+	if err := s.checkNotPending("load a state"); err != nil {
+		return err
+	}
+	var state saveState
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&state); err != nil {
+		return err
+	}
+	if state.InkSaveVersion < MinInkSaveVersion {
+		return fmt.Errorf("save version %d: %w", state.InkSaveVersion, ErrUnsupportedVersion)
+	}
+
+	l := stateLoader{root: &s.root}
+	// the story state is shared by every flow, and the choices in them
+	shared := storyState{
+		listDefs:  s.listDefs,
+		externals: s.externals,
+		compat:    s.compat,
+		limits:    s.limits,
+		globals:   l.globals("variablesState", s.globals, state.VariablesState),
+		visits:    l.visits(state.VisitCounts, state.TurnIndices),
+		turnCount: state.TurnIdx + 1,
+
+		storySeed:      state.StorySeed,
+		previousRandom: state.PreviousRandom,
+	}
+
+	current := DefaultFlowName
+	flows := make(map[string]snapshot)
+	if state.Flows != nil {
+		if state.CurrentFlowName != "" {
+			current = state.CurrentFlowName
+		}
+		if _, ok := state.Flows[current]; !ok {
+			l.errorf("currentFlowName", "flow %q not found", current)
+		}
+		for _, name := range slices.Sorted(maps.Keys(state.Flows)) {
+			flows[name] = l.flow("flows."+name+".", state.Flows[name], shared)
+		}
+	} else if state.CallstackThreads != nil {
+		flows[current] = l.flow("", flowState{
+			Callstack:      *state.CallstackThreads,
+			OutputStream:   state.OutputStream,
+			ChoiceThreads:  state.ChoiceThreads,
+			CurrentChoices: state.CurrentChoices,
+		}, shared)
+	} else {
+		l.errorf("flows", "missing flows")
+	}
+	evalStack := l.evalStack("evalStack", state.EvalStack)
+
+	if len(l.problems) > 0 {
+		return &StateError{Problems: l.problems}
+	}
+	flow := flows[current]
+	delete(flows, current)
+	// the eval stack is only saved for the current flow
+	se := flow.eval.(StepEvaluator)
+	se.Stack = se.Stack.withEvalStack(evalStack)
+	flow.eval = se
+	s.restore(flow)
+	s.flowName = current
+	s.flows = flows
+	return nil
+}
+
+// flow loads the callstack and choices of a flow. The path is the prefix for
+// the flow's fields.
+func (l *stateLoader) flow(path string, f flowState, shared storyState) snapshot {
+	var elem Element
+	var stepper Stepper = BaseEvaluator{}
+	var stack *CallFrame
+	threads := f.Callstack.Threads
+	if len(threads) == 0 {
+		l.errorf(path+"callstack.threads", "missing threads")
+	}
+	for i, t := range threads {
+		// the current thread is the last one, and each of the others continues
+		// once the thread after it is done
+		var fork *threadFork
+		if stack != nil {
+			fork = &threadFork{stack: stack, returnTo: elem, retStep: stepper}
+		}
+		stack, elem, stepper = l.thread(fmt.Sprintf("%scallstack.threads.%d", path, i), t)
+		if stack != nil {
+			stack.thread = fork
+		}
+	}
+	stepper = l.outputStream(path+"outputStream", f.OutputStream, stepper)
+	if stack != nil {
+		stack = stack.withStoryState(shared)
+		stack.choiceCount = len(f.CurrentChoices)
+	}
+
+	var choices []Choice
+	for i, c := range f.CurrentChoices {
+		tp := fmt.Sprintf("%schoiceThreads.%d", path, c.OriginalThreadIndex)
+		t, ok := f.ChoiceThreads[strconv.Itoa(c.OriginalThreadIndex)]
+		if !ok {
+			// the choice's thread may be one of the current threads
+			j := slices.IndexFunc(threads, func(t threadState) bool { return t.ThreadIndex == c.OriginalThreadIndex })
+			if j == -1 {
+				l.errorf(fmt.Sprintf("%scurrentChoices.%d", path, i), "thread %d not found", c.OriginalThreadIndex)
+				continue
+			}
+			tp = fmt.Sprintf("%scallstack.threads.%d", path, j)
+			t = threads[j]
+		}
+		choiceStack, _, choiceStepper := l.thread(tp, t)
+		src := l.element(fmt.Sprintf("%scurrentChoices.%d.originalChoicePath", path, i), Address(c.OriginalChoicePath))
+		dest := l.element(fmt.Sprintf("%scurrentChoices.%d.targetPath", path, i), Address(c.TargetPath))
+		if choiceStack == nil || src == nil || dest == nil {
+			continue
+		}
+		choiceStack = choiceStack.withStoryState(shared)
+		choices = append(choices, Choice{
+			Label: c.Text,
+			Tags:  c.Tags,
+			Dest: choiceElement{
+				node: Divert{Dest: Address(c.TargetPath)},
+				src:  src,
+			},
+			Eval: StepEvaluator{Stack: choiceStack, Stepper: choiceStepper},
+		})
+	}
+	return snapshot{
+		elem:    elem,
+		eval:    StepEvaluator{Stack: stack, Stepper: stepper},
+		choices: choices,
+		ended:   f.Ended,
+	}
+}
+
+type stateLoader struct {
+	loader
+	root *Container
+}
+
+func (l *stateLoader) value(path string, v any) Value {
+	if m, ok := v.(map[string]any); ok {
+		if tag, ok := m["#"]; ok {
+			return TagValue(l.string(path+".#", tag))
+		}
+	}
+	switch n := l.node(path, v).(type) {
+	case nil:
+		// the problem was already reported
+		return nil
+	case Text:
+		return StringValue(n)
+	case Newline:
+		return StringValue("\n")
+	case Void:
+		return VoidValue{}
+	case IntValue, FloatValue, BoolValue, ListValue, DivertTargetValue, VarRef:
+		return n
+	}
+	l.errorf(path, "expected a value, found %s", jsonType(v))
+	return nil
+}
+
+func (l *stateLoader) vars(path string, vars *Vars, m map[string]any) *Vars {
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		vars = vars.With(name, l.value(path+"."+name, m[name]))
+	}
+	return vars
+}
+
+// globals loads the saved globals over their initial values, since the
+// reference runtime doesn't save the globals which are unchanged.
+func (l *stateLoader) globals(path string, defaults *Vars, m map[string]any) *Vars {
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		if _, ok := defaults.Get(name); !ok {
+			l.errorf(path+"."+name, "variable is not declared")
+		}
+	}
+	return l.vars(path, defaults, m)
+}
+
+func (l *stateLoader) evalStack(path string, values []any) *EvalFrame {
+	var f *EvalFrame
+	for i, v := range values {
+		f = f.Push(l.value(fmt.Sprintf("%s.%d", path, i), v))
+	}
+	return f
+}
+
+func (l *stateLoader) element(path string, addr Address) Element {
+	el, _ := l.root.Find(addr)
+	if el == nil {
+		l.errorf(path, "no content at %q", addr)
+	}
+	return el
+}
+
+// thread loads the frames of a callstack, returning the innermost frame, the
+// current element, and the stepper for the current element.
+func (l *stateLoader) thread(path string, t threadState) (*CallFrame, Element, Stepper) {
+	if len(t.Callstack) == 0 {
+		l.errorf(path+".callstack", "callstack is empty")
+		return nil, nil, nil
+	}
+	var stack *CallFrame
+	var elem Element
+	var stepper Stepper
+	for i, fs := range t.Callstack {
+		fp := fmt.Sprintf("%s.callstack.%d", path, i)
+		f := &CallFrame{
+			locals:     l.vars(fp+".temp", nil, fs.Temp),
+			callDepth:  i,
+			isFunction: i > 0 && fs.Type != pushPopTunnel,
+		}
+		if stack != nil {
+			f.prev = stack
+			f.returnTo, f.retStep = elem, stepper
+		}
+		elem = nil
+		if fs.CPath != nil {
+			idx := 0
+			if fs.Idx != nil {
+				idx = *fs.Idx
+			}
+			if idx < 0 {
+				l.errorf(fp+".idx", "invalid index %d", idx)
+			} else {
+				elem = l.element(fp+".cPath", elementPath(Address(*fs.CPath), idx))
+			}
+		}
+		stepper = BaseEvaluator{}
+		if fs.Exp {
+			stepper = EvalEvaluator{Prev: BaseEvaluator{}}
+		}
+		stack = f
+	}
+	return stack, elem, stepper
+}
+
+// outputStream restores a tag in progress at the end of the output stream.
+// The rest of the output has already been returned to the host.
+func (l *stateLoader) outputStream(path string, stream []any, stepper Stepper) Stepper {
+	start := -1
+	for i, v := range stream {
+		switch v {
+		case "#":
+			start = i
+		case "/#":
+			start = -1
+		}
+	}
+	if start == -1 {
+		return stepper
+	}
+	tag := TagEvaluator{Prev: stepper}
+	for i, v := range stream[start+1:] {
+		if s, ok := l.value(fmt.Sprintf("%s.%d", path, start+1+i), v).(StringValue); ok {
+			tag.output += string(s)
+		}
+	}
+	return tag
+}
+
+func (l *stateLoader) visits(visitCounts, turnIndices map[string]int) *Visit {
+	var visits *Visit
+	for _, addr := range slices.Sorted(maps.Keys(turnIndices)) {
+		if visitCounts[addr] <= 0 {
+			visits = &Visit{
+				Address:   Address(addr),
+				EntryTurn: turnIndices[addr] + 1,
+				Prev:      visits,
+			}
+		}
+	}
+	for _, addr := range slices.Sorted(maps.Keys(visitCounts)) {
+		count := visitCounts[addr]
+		if count < 0 {
+			l.errorf("visitCounts."+addr, "negative visit count %d", count)
+		}
+		if count <= 0 {
+			continue
+		}
+		turn, ok := turnIndices[addr]
+		if !ok {
+			turn = -1
+		}
+		// a single entry holds the count, since it comes from the save
+		visits = &Visit{
+			Address:   Address(addr),
+			IsVisit:   true,
+			EntryTurn: turn + 1,
+			Prev:      visits,
+			count:     count,
+		}
+	}
+	return visits
+}
@@ -0,0 +1,312 @@
+package gouache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reload saves the state of the story and loads it into a new story.
+func reload(t TBMinimal, story *Story, container Container, listDefs ListDefs) *Story {
+	t.Helper()
+	var b bytes.Buffer
+	require.NoError(t, story.SaveState(&b))
+	loaded := mustNewStory(t, container, listDefs)
+	require.NoError(t, loaded.LoadState(&b))
+	return loaded
+}
+
+func TestStateSamples(t *testing.T) {
+	for _, name := range samples {
+		t.Run(name, func(t *testing.T) {
+			base := "./testdata/" + name + ".ink"
+			expected := readfile(t, base+".txt")
+			container, listDefs := load(t, base+".json")
+			var b strings.Builder
+			story := reload(t, mustNewStory(t, container, listDefs), container, listDefs)
+			b.WriteString(mustContinue(t, story))
+			for choices := story.CurrentChoices(); len(choices) > 0; choices = story.CurrentChoices() {
+				b.WriteRune('\n')
+				for i, choice := range choices {
+					fmt.Fprintf(&b, "%d: %s\n", i+1, choice.Label)
+				}
+				b.WriteString("?> ")
+				story = reload(t, story, container, listDefs)
+				require.NoError(t, story.ChooseChoiceIndex(0))
+				b.WriteString(mustContinue(t, story))
+			}
+			assert.Equal(t, expected, b.String())
+		})
+	}
+}
+
+func TestStateSamplesByLine(t *testing.T) {
+	for _, name := range append(samples, "tags", "tags-dynamic") {
+		t.Run(name, func(t *testing.T) {
+			container, listDefs := load(t, "./testdata/"+name+".ink.json")
+			var expected, actual []string
+			story := mustNewStory(t, container, listDefs)
+			for story.CanContinue() {
+				line := mustContinueLine(t, story)
+				expected = append(expected, line+strings.Join(story.CurrentTags(), ","))
+			}
+			story = mustNewStory(t, container, listDefs)
+			for story.CanContinue() {
+				line := mustContinueLine(t, story)
+				actual = append(actual, line+strings.Join(story.CurrentTags(), ","))
+				story = reload(t, story, container, listDefs)
+			}
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	container, listDefs := load(t, "./testdata/visit-count.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	mustContinue(t, story)
+	require.NoError(t, story.ChooseChoiceIndex(1))
+	mustContinue(t, story)
+
+	var b bytes.Buffer
+	require.NoError(t, story.SaveState(&b))
+	var state map[string]any
+	require.NoError(t, json.Unmarshal(b.Bytes(), &state))
+	assert.Equal(t, "DEFAULT_FLOW", state["currentFlowName"])
+	assert.Equal(t, float64(10), state["inkSaveVersion"])
+	assert.Equal(t, float64(0), state["turnIdx"])
+	assert.Equal(t, map[string]any{
+		"loop_1":       float64(2),
+		"loop_1.0.c-1": float64(1),
+		"loop_2":       float64(1),
+	}, state["visitCounts"])
+	assert.Equal(t, map[string]any{}, state["variablesState"])
+	assert.Equal(t, []any{}, state["evalStack"])
+
+	flow := state["flows"].(map[string]any)["DEFAULT_FLOW"].(map[string]any)
+	choices := flow["currentChoices"].([]any)
+	// the choice taken is once-only and the fallback choice is invisible
+	require.Len(t, choices, 2)
+	assert.Equal(t, map[string]any{
+		"text":                "choice three",
+		"index":               float64(1),
+		"originalChoicePath":  "loop_1.0.19.8",
+		"originalThreadIndex": float64(2),
+		"targetPath":          "loop_1.0.c-2",
+	}, choices[1])
+	threads := flow["callstack"].(map[string]any)["threads"].([]any)
+	require.Len(t, threads, 1)
+}
+
+func TestSaveStateValues(t *testing.T) {
+	for _, tc := range []struct {
+		value Value
+		json  string
+	}{
+		{IntValue(3), `3`},
+		{FloatValue(2), `2.0`},
+		{FloatValue(1.5), `1.5`},
+		{BoolValue(true), `true`},
+		{StringValue("hi"), `"^hi"`},
+		{StringValue("\n"), `"\n"`},
+		{DivertTargetValue{Dest: "knot.stitch"}, `{"^->":"knot.stitch"}`},
+		{VarRef{Name: "x", ContentIndex: 1}, `{"^var":"x","ci":1}`},
+		{ListSingle("colors", "red", 1), `{"list":{"colors.red":1}}`},
+		{ListEmpty("colors"), `{"list":{},"origins":["colors"]}`},
+		{VoidValue{}, `"void"`},
+	} {
+		t.Run(tc.json, func(t *testing.T) {
+			j, err := saveValue(tc.value)
+			require.NoError(t, err)
+			b, err := json.Marshal(j)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.json, string(b))
+
+			var v any
+			dec := json.NewDecoder(bytes.NewReader(b))
+			dec.UseNumber()
+			require.NoError(t, dec.Decode(&v))
+			var l stateLoader
+			assert.Equal(t, tc.value, l.value("v", v))
+			assert.Empty(t, l.problems)
+		})
+	}
+}
+
+func TestStateListOrder(t *testing.T) {
+	// VAR x = (cherry) + (apple)
+	// {LIST_RANDOM(x)}
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [
+			["ev", {"VAR?": "x"}, "lrnd", "out", "/ev", "\n", "done", null],
+			"done",
+			{"global decl": ["ev", {"list": {"fruit.cherry": 3}}, {"list": {"fruit.apple": 1}}, "+", {"VAR=": "x"}, "/ev", "end", null]}
+		],
+		"listDefs": {"fruit": {"apple": 1, "banana": 2, "cherry": 3}}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+	var b bytes.Buffer
+	require.NoError(t, story.SaveState(&b))
+	// the items are saved in the order they were added, like the reference
+	// runtime, rather than sorted
+	assert.Contains(t, b.String(), `{"list":{"fruit.cherry":3,"fruit.apple":1}}`)
+
+	story = reload(t, story, container, listDefs)
+	// the first number from seed 0 is even, so LIST_RANDOM picks the first
+	// item added to the list
+	story.SetRandomState(0, 0)
+	assert.Equal(t, "cherry\n", mustContinue(t, story))
+}
+
+func TestLoadStateLegacy(t *testing.T) {
+	container, listDefs := load(t, "./testdata/global.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	// before version 10, the default flow was saved at the top level
+	state := `{
+		"callstackThreads": {
+			"threads": [{"callstack": [{"cPath": "0", "idx": 0, "exp": false, "type": 0}], "threadIndex": 0}],
+			"threadCounter": 0
+		},
+		"outputStream": [],
+		"currentChoices": [],
+		"variablesState": {"v": "^bar"},
+		"evalStack": [],
+		"visitCounts": {},
+		"turnIndices": {},
+		"turnIdx": -1,
+		"storySeed": 0,
+		"inkSaveVersion": 9,
+		"inkFormatVersion": 21
+	}`
+	require.NoError(t, story.LoadState(strings.NewReader(state)))
+	assert.Equal(t, "v=bar\n", mustContinue(t, story))
+}
+
+func TestLoadStateProblems(t *testing.T) {
+	container, listDefs := load(t, "./testdata/global.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	state := `{
+		"flows": {"DEFAULT_FLOW": {
+			"callstack": {
+				"threads": [{"callstack": [{"cPath": "missing", "idx": 0, "exp": false, "type": 0}], "threadIndex": 0}],
+				"threadCounter": 0
+			},
+			"outputStream": [],
+			"currentChoices": []
+		}},
+		"currentFlowName": "DEFAULT_FLOW",
+		"variablesState": {"v": "ev", "w": 1},
+		"evalStack": [],
+		"visitCounts": {},
+		"turnIndices": {},
+		"turnIdx": -1,
+		"storySeed": 0,
+		"inkSaveVersion": 10,
+		"inkFormatVersion": 21
+	}`
+	err := story.LoadState(strings.NewReader(state))
+	var stateErr *StateError
+	require.True(t, errors.As(err, &stateErr), "expected a StateError, got %v", err)
+	assert.ElementsMatch(t, []LoadProblem{
+		{Path: "variablesState.v", Message: `expected a value, found string "ev"`},
+		{Path: "variablesState.w", Message: "variable is not declared"},
+		{Path: "flows.DEFAULT_FLOW.callstack.threads.0.callstack.0.cPath", Message: `no content at "missing.0"`},
+	}, stateErr.Problems)
+	// the story is left unchanged
+	assert.Equal(t, "v=foo\n", mustContinue(t, story))
+}
+
+func TestLoadStateInvalidPaths(t *testing.T) {
+	container, listDefs := load(t, "./testdata/global.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	state := `{
+		"flows": {"DEFAULT_FLOW": {
+			"callstack": {
+				"threads": [{"callstack": [{"cPath": "0", "idx": 0, "exp": false, "type": 0}], "threadIndex": 0}],
+				"threadCounter": 0
+			},
+			"outputStream": [],
+			"currentChoices": [
+				{"text": "x", "index": 0, "originalChoicePath": "0.-1", "originalThreadIndex": 0, "targetPath": "0.c-9"}
+			]
+		}},
+		"currentFlowName": "DEFAULT_FLOW",
+		"variablesState": {},
+		"evalStack": [],
+		"visitCounts": {},
+		"turnIndices": {},
+		"turnIdx": -1,
+		"storySeed": 0,
+		"inkSaveVersion": 10,
+		"inkFormatVersion": 21
+	}`
+	err := story.LoadState(strings.NewReader(state))
+	var stateErr *StateError
+	require.ErrorAs(t, err, &stateErr)
+	assert.Equal(t, []LoadProblem{
+		{Path: "flows.DEFAULT_FLOW.currentChoices.0.originalChoicePath", Message: `no content at "0.-1"`},
+		{Path: "flows.DEFAULT_FLOW.currentChoices.0.targetPath", Message: `no content at "0.c-9"`},
+	}, stateErr.Problems)
+	assert.Equal(t, "v=foo\n", mustContinue(t, story))
+}
+
+func TestLoadStateVisitCounts(t *testing.T) {
+	container, listDefs := load(t, "./testdata/global.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	state := `{
+		"flows": {"DEFAULT_FLOW": {
+			"callstack": {
+				"threads": [{"callstack": [{"cPath": "0", "idx": 0, "exp": false, "type": 0}], "threadIndex": 0}],
+				"threadCounter": 0
+			},
+			"outputStream": [],
+			"currentChoices": []
+		}},
+		"currentFlowName": "DEFAULT_FLOW",
+		"variablesState": {},
+		"evalStack": [],
+		"visitCounts": {"0": 1000000000000},
+		"turnIndices": {},
+		"turnIdx": -1,
+		"storySeed": 0,
+		"inkSaveVersion": 10,
+		"inkFormatVersion": 21
+	}`
+	// a large count is kept as a number rather than an entry per visit
+	require.NoError(t, story.LoadState(strings.NewReader(state)))
+	assert.Equal(t, 1000000000000, story.eval.(StepEvaluator).Stack.VisitCount("0"))
+	saved, err := story.saveState()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"0": 1000000000000}, saved.VisitCounts)
+
+	err = story.LoadState(strings.NewReader(strings.Replace(state, "1000000000000", "-1", 1)))
+	var stateErr *StateError
+	require.ErrorAs(t, err, &stateErr)
+	assert.Equal(t, []LoadProblem{
+		{Path: "visitCounts.0", Message: "negative visit count -1"},
+	}, stateErr.Problems)
+}
+
+func TestLoadStateEnded(t *testing.T) {
+	container, listDefs := load(t, "./testdata/end.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	mustContinue(t, story)
+	require.Equal(t, StatusEnded, story.Status())
+	story = reload(t, story, container, listDefs)
+	assert.Equal(t, StatusEnded, story.Status())
+}
+
+func TestLoadStateUnsupportedVersion(t *testing.T) {
+	container, listDefs := load(t, "./testdata/global.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	err := story.LoadState(strings.NewReader(`{"inkSaveVersion": 7}`))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
@@ -0,0 +1,443 @@
+package gouache
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/mgood/gouache/glue"
+)
+
+// Story runs a loaded ink story, tracking the current position in the story
+// and the choices available to the player. It mirrors the API of the official
+// ink runtime.
+type Story struct {
+	root     Container
+	listDefs ListDefs
+	// globals are the initial values of the global variables
+	globals   *Vars
+	externals map[string]ExternalFunction
+	observers map[string][]VariableObserver
+	// batchObservers notifies the observers at the end of each Continue
+	batchObservers bool
+	// compat follows the number semantics of the reference runtime
+	compat bool
+	limits Limits
+	// flows holds the state of each flow other than the current one
+	flows map[string]snapshot
+
+	flowName string
+	elem     Element
+	eval     Evaluator
+	choices  []Choice
+	tags     []string
+	// warnings are collected during each Continue
+	warnings []Warning
+	// pending is a call to ContinueAsync that hasn't finished
+	pending *continuation
+	// ended is set once the story reaches END
+	ended bool
+}
+
+// NewStory creates a story positioned at the start of the root container.
+func NewStory(c Container, listDefs ListDefs) (*Story, error) {
+	return NewStoryWithOptions(c, listDefs, Options{})
+}
+
+// Options are the settings of a story which also apply while the global
+// variables are initialized.
+type Options struct {
+	// Limits are the limits set by SetLimits.
+	Limits Limits
+	// Compatibility is the number semantics set by SetCompatibility.
+	Compatibility bool
+}
+
+// NewStoryWithOptions creates a story like NewStory, with the options already
+// set while the global variables are initialized.
+func NewStoryWithOptions(c Container, listDefs ListDefs, opts Options) (story *Story, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("initializing story: %w", recoveredError(r))
+		}
+	}()
+	elem, eval := initWithOptions(c, listDefs, opts)
+	// the bindings are shared by every frame, so that binding a function
+	// applies to the whole story
+	externals := make(map[string]ExternalFunction)
+	se := eval.(StepEvaluator)
+	// like the reference runtime, each story starts with a small random seed
+	se.Stack = se.Stack.withExternals(externals).SeedRandom(rand.Int64N(100))
+	return &Story{
+		root:      c,
+		listDefs:  listDefs,
+		globals:   se.Stack.globals,
+		externals: externals,
+		compat:    opts.Compatibility,
+		limits:    opts.Limits,
+		flowName:  DefaultFlowName,
+		elem:      elem,
+		eval:      se,
+	}, nil
+}
+
+// SetCompatibility sets whether numbers follow the reference runtime exactly,
+// with 32-bit ints that wrap around on overflow, and single precision floats
+// printed the way C# formats them, such as "1E+10" rather than "1e+10".
+// The global variables have already been initialized, so to declare them with
+// the same semantics, set Options.Compatibility with NewStoryWithOptions.
+func (s *Story) SetCompatibility(compat bool) {
+	s.compat = compat
+	se := s.eval.(StepEvaluator)
+	se.Stack = se.Stack.withCompat(compat)
+	s.eval = se
+}
+
+// snapshot is the state of a story, which can be restored to rewind the story.
+type snapshot struct {
+	elem    Element
+	eval    Evaluator
+	choices []Choice
+	tags    []string
+	ended   bool
+}
+
+func (s *Story) snapshot() snapshot {
+	return snapshot{
+		elem:    s.elem,
+		eval:    s.eval,
+		choices: s.choices,
+		tags:    s.tags,
+		ended:   s.ended,
+	}
+}
+
+func (snap snapshot) globals() *Vars {
+	return snap.eval.(StepEvaluator).Stack.globals
+}
+
+func (s *Story) restore(snap snapshot) {
+	s.elem = snap.elem
+	s.eval = snap.eval
+	s.choices = snap.choices
+	s.tags = snap.tags
+	s.ended = snap.ended
+}
+
+// GlobalTags returns the tags at the very start of the story, which are
+// typically used for metadata such as the title or author.
+func (s *Story) GlobalTags() ([]string, error) {
+	return s.root.GlobalTags()
+}
+
+// TagsForContentAtPath returns the tags at the very start of a knot or stitch,
+// such as "knot" or "knot.stitch".
+func (s *Story) TagsForContentAtPath(path string) ([]string, error) {
+	return s.root.TagsAt(Address(path))
+}
+
+// CanContinue reports whether there is more content to generate before
+// reaching the next set of choices or the end of the story.
+func (s *Story) CanContinue() bool {
+	return s.elem != nil
+}
+
+// Continue generates the story text up to the next set of choices or the end
+// of the story. The tags from all of the lines are available from CurrentTags.
+// If a call to ContinueAsync or ContinueContext stopped early, this finishes
+// its text.
+//
+// If the story fails, the error is a *RuntimeError and the story is left in
+// the state from before the call.
+func (s *Story) Continue() (string, error) {
+	return s.continueUntil(func() error { return nil })
+}
+
+// ContinueLine generates the next line of story text. After reaching a
+// newline the story keeps evaluating, in case the newline is removed by glue,
+// until more text or a tag confirms the end of the line. The story is then
+// rewound to the end of the line, so that the next call resumes from there.
+// Calling an external function which isn't lookahead safe also ends the line,
+// so that its side effects happen with the next line.
+//
+// The tags for the line are available from CurrentTags. As in the reference
+// runtime, tags at the start of a line, or following text on the same line,
+// belong to that line.
+//
+// If the story fails, the error is a *RuntimeError and the story is left in
+// the state from before the call.
+func (s *Story) ContinueLine() (string, error) {
+	if err := s.checkNotPending("continue a line"); err != nil {
+		return "", err
+	}
+	start := s.snapshot()
+	var b strings.Builder
+	w := glue.NewWriter(&b)
+	s.tags = nil
+	s.warnings = nil
+	var batch []varChange
+	// lineEnd is where the line ends if the pending newline isn't removed by
+	// glue. The steps after it are only looking ahead, so the story is rewound
+	// to it, and the next call runs them again.
+	var lineEnd *lookahead
+	for steps := 1; s.CanContinue(); steps++ {
+		pending := glue.PendingNewline(w)
+		if pending && lineEnd == nil {
+			lineEnd = &lookahead{
+				snap:     s.snapshot(),
+				n:        b.Len(),
+				warnings: len(s.warnings),
+			}
+		} else if !pending && lineEnd != nil {
+			// glue removed the newline, so the steps since are part of the line
+			s.observe(lineEnd.snap.globals(), &batch)
+			lineEnd = nil
+		}
+		if lineEnd != nil && s.atLookaheadUnsafe() {
+			// end the line, so the function is called with the next line
+			return s.endLine(lineEnd, b.String(), batch), nil
+		}
+		before := s.globalVars()
+		n := b.Len()
+		el := s.elem
+		out, err := s.step()
+		if err != nil {
+			s.restore(start)
+			return "", err
+		}
+		text, tags := glue.SplitTags(out.String())
+		w.WriteString(text)
+		if lineEnd != nil && (len(tags) > 0 || b.Len() > n && b.String()[n] == '\n') {
+			return s.endLine(lineEnd, b.String(), batch), nil
+		}
+		if err := s.checkLimits(el, steps, b.Len()); err != nil {
+			s.restore(start)
+			return "", err
+		}
+		s.tags = append(s.tags, tags...)
+		if lineEnd == nil {
+			s.observe(before, &batch)
+		}
+	}
+	if lineEnd != nil {
+		s.observe(lineEnd.snap.globals(), &batch)
+	}
+	w.WriteEnd()
+	s.flushObservers(batch)
+	return b.String(), nil
+}
+
+// lookahead is the state of the story at a newline, while ContinueLine looks
+// ahead for the end of the line.
+type lookahead struct {
+	snap     snapshot
+	n        int // the length of the output up to the newline
+	warnings int
+}
+
+// endLine rewinds the story to the end of the line and returns its text. The
+// observers aren't notified of the steps that are rewound, and their warnings
+// are dropped, since they're repeated by the next call.
+func (s *Story) endLine(end *lookahead, out string, batch []varChange) string {
+	s.restore(end.snap)
+	s.warnings = s.warnings[:end.warnings]
+	s.flushObservers(batch)
+	return out[:end.n] + "\n"
+}
+
+// RandomState returns the seed of the story's random numbers, and the previous
+// random number, which together determine the numbers that follow.
+func (s *Story) RandomState() (seed, previous int64) {
+	stack := s.eval.(StepEvaluator).Stack
+	return stack.storySeed, stack.previousRandom
+}
+
+// SetRandomState sets the seed of the story's random numbers and the position
+// in the sequence, as returned by RandomState, so that the story generates the
+// same random numbers again. The seed also determines the order of shuffle
+// sequences.
+func (s *Story) SetRandomState(seed, previous int64) {
+	se := s.eval.(StepEvaluator)
+	se.Stack = se.Stack.SeedRandom(seed)
+	se.Stack.previousRandom = previous
+	s.eval = se
+}
+
+// Status is the state of a story between calls to Continue.
+type Status int
+
+const (
+	// StatusCanContinue means there's more content before the next choices.
+	StatusCanContinue Status = iota
+	// StatusWaitingForChoice means the player must choose one of the current
+	// choices.
+	StatusWaitingForChoice
+	// StatusDone means the story ran out of content at DONE, or at the end of
+	// the root container, without any choices.
+	StatusDone
+	// StatusEnded means the story reached END.
+	StatusEnded
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusCanContinue:
+		return "can continue"
+	case StatusWaitingForChoice:
+		return "waiting for choice"
+	case StatusDone:
+		return "done"
+	case StatusEnded:
+		return "ended"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Status reports whether the story can continue, is waiting for a choice, or
+// has finished.
+func (s *Story) Status() Status {
+	switch {
+	case s.CanContinue():
+		return StatusCanContinue
+	case len(s.CurrentChoices()) > 0:
+		return StatusWaitingForChoice
+	case s.ended:
+		return StatusEnded
+	default:
+		return StatusDone
+	}
+}
+
+// CurrentTags returns the tags for the text generated by the last call to
+// Continue or ContinueLine.
+func (s *Story) CurrentTags() []string {
+	return s.tags
+}
+
+// CurrentChoices returns the choices available to the player once the story
+// can no longer continue.
+func (s *Story) CurrentChoices() []Choice {
+	return visibleChoices(s.choices)
+}
+
+// visibleChoices returns the choices other than the invisible default.
+func visibleChoices(all []Choice) []Choice {
+	var choices []Choice
+	for _, choice := range all {
+		if !choice.IsInvisibleDefault {
+			choices = append(choices, choice)
+		}
+	}
+	return choices
+}
+
+// ChooseChoiceIndex selects one of the current choices by its index in
+// CurrentChoices, so that the story can continue from that choice.
+func (s *Story) ChooseChoiceIndex(i int) error {
+	if err := s.checkNotPending("choose a choice"); err != nil {
+		return err
+	}
+	choices := s.CurrentChoices()
+	if i < 0 || i >= len(choices) {
+		return fmt.Errorf("choice index %d out of range, have %d choices", i, len(choices))
+	}
+	s.choose(choices[i])
+	return nil
+}
+
+// ChoosePath moves the story to a knot or stitch, such as "knot.stitch",
+// passing any arguments to the knot. The values are converted as for
+// Variables.Set. As in the reference runtime, this resets the callstack,
+// discards the current choices, and counts as a new turn.
+func (s *Story) ChoosePath(path string, args ...any) error {
+	if err := s.checkNotPending("choose a path"); err != nil {
+		return err
+	}
+	dest, visitAddrs := s.root.Find(Address(path))
+	if dest == nil {
+		return fmt.Errorf("no content at path %q", path)
+	}
+	stack := s.eval.(StepEvaluator).Stack.resetCallstack()
+	for i, arg := range args {
+		v, err := toValue(arg)
+		if err != nil {
+			return fmt.Errorf("argument %d: %w", i, err)
+		}
+		stack = stack.PushVal(v)
+	}
+	stack = visit("", visitAddrs, stack.IncTurnCount())
+	s.elem = dest
+	s.eval = StepEvaluator{Stack: stack, Stepper: BaseEvaluator{}}
+	s.choices = nil
+	s.ended = false
+	return nil
+}
+
+func (s *Story) choose(choice Choice) {
+	// the choice keeps the callstack from where it was generated, but the
+	// variables and visits may have changed since then
+	eval := choice.Eval.(StepEvaluator)
+	eval.Stack = eval.Stack.withShared(s.eval.(StepEvaluator).Stack)
+	if !choice.IsInvisibleDefault {
+		eval.Stack = eval.Stack.IncTurnCount()
+	}
+	s.elem = choice.Dest
+	s.eval = eval
+	s.choices = nil
+}
+
+// step evaluates the current element, collecting any choice it generates.
+// Once the content runs out, the invisible default choice is followed if
+// there are no other choices for the player.
+//
+// The runtime panics with an inkError when the story fails, so those are
+// recovered here to report them with the location of the failing element.
+func (s *Story) step() (out Output, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newRuntimeError(r, s.elem, s.eval)
+		}
+	}()
+	from := s.elem
+	if n, ok := from.Node().(SetVar); ok && n.Reassign && !s.eval.(StepEvaluator).Stack.hasVar(n.Name) {
+		s.warn(from, fmt.Sprintf("setting undeclared global variable %q", n.Name))
+	}
+	_, end := from.Node().(End)
+	_, done := from.Node().(Done)
+	out, choice, elem, eval := s.eval.Step(s.elem)
+	s.elem, s.eval = elem, eval
+	if choice != nil {
+		s.choices = append(s.choices, *choice)
+		if choice.Label == "" && !choice.IsInvisibleDefault {
+			s.warn(from, "choice has no text")
+		}
+	}
+	if end {
+		// the choices generated this turn are dropped at the end of the story
+		s.choices = nil
+		s.ended = true
+	}
+	if elem == nil && len(s.CurrentChoices()) == 0 {
+		for _, choice := range s.choices {
+			if choice.IsInvisibleDefault {
+				s.choose(choice)
+				break
+			}
+		}
+	}
+	if s.elem == nil && len(s.choices) == 0 && !end && !done {
+		s.warn(from, "ran out of content, do you need a '-> DONE' or '-> END'?")
+	}
+	return out, nil
+}
+
+func (s *Story) warn(el Element, msg string) {
+	s.warnings = append(s.warnings, newWarning(el, msg))
+}
+
+// Warnings returns the problems found by the last call to Continue or
+// ContinueLine, such as running out of content without reaching DONE or END.
+// They don't stop the story, but usually point to a mistake in the script.
+func (s *Story) Warnings() []Warning {
+	return s.warnings
+}
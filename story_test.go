@@ -0,0 +1,825 @@
+package gouache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustNewStory(t TBMinimal, container Container, listDefs ListDefs) *Story {
+	t.Helper()
+	story, err := NewStory(container, listDefs)
+	require.NoError(t, err)
+	return story
+}
+
+func mustContinue(t TBMinimal, story *Story) string {
+	t.Helper()
+	text, err := story.Continue()
+	require.NoError(t, err)
+	return text
+}
+
+func mustContinueLine(t TBMinimal, story *Story) string {
+	t.Helper()
+	text, err := story.ContinueLine()
+	require.NoError(t, err)
+	return text
+}
+
+func TestStorySamples(t *testing.T) {
+	for _, name := range samples {
+		t.Run(name, func(t *testing.T) {
+			base := "./testdata/" + name + ".ink"
+			expected := readfile(t, base+".txt")
+			container, listDefs := load(t, base+".json")
+			var b strings.Builder
+			story := mustNewStory(t, container, listDefs)
+			b.WriteString(mustContinue(t, story))
+			for choices := story.CurrentChoices(); len(choices) > 0; choices = story.CurrentChoices() {
+				b.WriteRune('\n')
+				for i, choice := range choices {
+					fmt.Fprintf(&b, "%d: %s\n", i+1, choice.Label)
+				}
+				b.WriteString("?> ")
+				require.NoError(t, story.ChooseChoiceIndex(0))
+				b.WriteString(mustContinue(t, story))
+			}
+			assert.Equal(t, expected, b.String())
+		})
+	}
+}
+
+func TestStoryChooseChoiceIndexOutOfRange(t *testing.T) {
+	container, listDefs := load(t, "./testdata/sample.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.True(t, story.CanContinue())
+	assert.Equal(t, "Once upon a time...\n", mustContinue(t, story))
+	assert.False(t, story.CanContinue())
+	assert.Len(t, story.CurrentChoices(), 2)
+	assert.Error(t, story.ChooseChoiceIndex(2))
+	assert.Error(t, story.ChooseChoiceIndex(-1))
+	assert.NoError(t, story.ChooseChoiceIndex(1))
+	assert.True(t, story.CanContinue())
+	assert.Equal(t, "Choice two\n", mustContinue(t, story))
+}
+
+func TestStoryContinueLine(t *testing.T) {
+	container, listDefs := load(t, "./testdata/glue.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	var lines []string
+	for story.CanContinue() {
+		lines = append(lines, mustContinueLine(t, story))
+	}
+	assert.Equal(t, []string{
+		"glue directly betweenwords\n",
+		"glue betweenlines\n",
+		"glue newline space after line\n",
+		"glue first linethen newline\n",
+		"space before glue space after newline\n",
+	}, lines)
+}
+
+func TestStoryContinueLineSamples(t *testing.T) {
+	for _, name := range samples {
+		t.Run(name, func(t *testing.T) {
+			base := "./testdata/" + name + ".ink"
+			expected := readfile(t, base+".txt")
+			container, listDefs := load(t, base+".json")
+			var b strings.Builder
+			story := mustNewStory(t, container, listDefs)
+			continueLines := func() {
+				for story.CanContinue() {
+					line := mustContinueLine(t, story)
+					if line != "" {
+						assert.Equal(t, strings.Index(line, "\n"), len(line)-1, "expected a single line: %q", line)
+					}
+					b.WriteString(line)
+				}
+			}
+			continueLines()
+			for choices := story.CurrentChoices(); len(choices) > 0; choices = story.CurrentChoices() {
+				b.WriteRune('\n')
+				for i, choice := range choices {
+					fmt.Fprintf(&b, "%d: %s\n", i+1, choice.Label)
+				}
+				b.WriteString("?> ")
+				require.NoError(t, story.ChooseChoiceIndex(0))
+				continueLines()
+			}
+			assert.Equal(t, expected, b.String())
+		})
+	}
+}
+
+func TestStoryLineTags(t *testing.T) {
+	container, listDefs := load(t, "./testdata/tags.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "A line with a tag\n", mustContinueLine(t, story))
+	assert.Equal(t, []string{"author: Joe", "title: Tags", "happy"}, story.CurrentTags())
+	assert.Equal(t, "Second line\n", mustContinueLine(t, story))
+	assert.Equal(t, []string{"before"}, story.CurrentTags())
+	assert.Equal(t, "Glued line\n", mustContinueLine(t, story))
+	assert.Equal(t, []string{"glue"}, story.CurrentTags())
+	assert.False(t, story.CanContinue())
+}
+
+func TestStoryContinueTags(t *testing.T) {
+	container, listDefs := load(t, "./testdata/tags.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "A line with a tag\nSecond line\nGlued line\n", mustContinue(t, story))
+	assert.Equal(t, []string{"author: Joe", "title: Tags", "happy", "before", "glue"}, story.CurrentTags())
+}
+
+func TestStoryDynamicTags(t *testing.T) {
+	container, listDefs := load(t, "./testdata/tags-dynamic.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Hello\n", mustContinueLine(t, story))
+	assert.Equal(t, []string{"mood: furious", "count: 5", "level: level 5"}, story.CurrentTags())
+}
+
+func TestStoryChoiceTags(t *testing.T) {
+	container, listDefs := load(t, "./testdata/choice-tags.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "What now?\n", mustContinue(t, story))
+	assert.Empty(t, story.CurrentTags())
+	choices := story.CurrentChoices()
+	require.Len(t, choices, 2)
+	assert.Equal(t, "Open the door", choices[0].Label)
+	assert.Equal(t, []string{"sfx:creak"}, choices[0].Tags)
+	assert.Equal(t, "Fight", choices[1].Label)
+	assert.Equal(t, []string{"aggressive", "loud"}, choices[1].Tags)
+	require.NoError(t, story.ChooseChoiceIndex(1))
+	assert.Equal(t, "You fight.\n", mustContinue(t, story))
+	assert.Empty(t, story.CurrentTags())
+}
+
+func TestStoryStringTags(t *testing.T) {
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [[
+			"ev", "str", "^hi ", "#", "^ignored", "/#", "/str", "out", "/ev", "\n",
+			"ev", "str", "^ padded ", "/str", "/ev", {"*": ".^.c-0", "flg": 4},
+			{"c-0": ["done", null]}
+		], "done", null],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "hi\n", mustContinue(t, story))
+	choices := story.CurrentChoices()
+	require.Len(t, choices, 1)
+	// a tag in a string outside a choice isn't left for the next choice
+	assert.Empty(t, choices[0].Tags)
+	assert.Nil(t, story.eval.(StepEvaluator).Stack.evalStack)
+	// labels are only trimmed where a tag was removed
+	assert.Equal(t, " padded ", choices[0].Label)
+}
+
+func TestStoryGlobalTags(t *testing.T) {
+	container, listDefs := load(t, "./testdata/tags.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	tags, err := story.GlobalTags()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"author: Joe", "title: Tags"}, tags)
+
+	tags, err = story.TagsForContentAtPath("tavern")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"location: tavern", "music: theme2"}, tags)
+
+	_, err = story.TagsForContentAtPath("cellar")
+	assert.Error(t, err)
+	_, err = story.TagsForContentAtPath("0.-1")
+	assert.Error(t, err)
+	_, err = story.TagsForContentAtPath("0.1000")
+	assert.Error(t, err)
+
+	// querying tags doesn't affect the story state
+	assert.Equal(t, "A line with a tag\n", mustContinueLine(t, story))
+}
+
+func TestDynamicGlobalTags(t *testing.T) {
+	container, _ := load(t, "./testdata/tags-dynamic.ink.json")
+	tags, err := container.GlobalTags()
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+}
+
+func TestTagsAfterControlCommands(t *testing.T) {
+	container, _, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [["done", null], "done", {
+			"knot": ["ev", "/ev", "#", "^first", "/#", "nop", "#", "^second", "/#", "^Text.", "\n", "#", "^later", "/#", "done", null]
+		}],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	tags, err := container.TagsAt("knot")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, tags)
+}
+
+func TestStoryRuntimeError(t *testing.T) {
+	c := Container{
+		Contents: []Node{
+			Container{
+				Contents: []Node{
+					Text("before"),
+					Newline{},
+					BeginEval{},
+					FuncCall{Dest: "f"},
+					Out{},
+					EndEval{},
+					Done{},
+				},
+			},
+		},
+		Nested: map[string]Container{
+			"f": {
+				Name: "f",
+				Contents: []Node{
+					BeginEval{},
+					GetVar{Name: "missing"},
+					EndEval{},
+					FuncReturn{},
+				},
+			},
+		},
+	}
+	story := mustNewStory(t, c, nil)
+	_, err := story.Continue()
+	var rerr *RuntimeError
+	require.True(t, errors.As(err, &rerr), "expected a runtime error, got %v", err)
+	assert.Equal(t, Address("f"), rerr.Address)
+	assert.Equal(t, 1, rerr.Index)
+	assert.Equal(t, GetVar{Name: "missing"}, rerr.Node)
+	assert.Equal(t, []Address{"0.3"}, rerr.CallStack)
+	assert.ErrorContains(t, err, `variable "missing" not found`)
+
+	// the story is left in the state from before the error
+	assert.True(t, story.CanContinue())
+	_, err = story.ContinueLine()
+	assert.ErrorAs(t, err, &rerr)
+	assert.True(t, story.CanContinue())
+}
+
+func TestStoryInitError(t *testing.T) {
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [
+			["done", null],
+			"done",
+			{"global decl": ["ev", 1, {"VAR=": "x"}, {"VAR?": "missing"}, {"VAR=": "y"}, "/ev", "end", null]}
+		],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	_, err = NewStory(container, listDefs)
+	var rerr *RuntimeError
+	require.True(t, errors.As(err, &rerr), "expected a runtime error, got %v", err)
+	assert.Equal(t, Address("global decl"), rerr.Address)
+	assert.Equal(t, 3, rerr.Index)
+	assert.Equal(t, GetVar{Name: "missing"}, rerr.Node)
+	assert.ErrorContains(t, err, `variable "missing" not found`)
+
+	// going past a limit fails at an element too
+	container, listDefs, err = LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [["done", null], "done", {"global decl": [{"->": "global decl"}, null]}],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	_, err = NewStoryWithOptions(container, listDefs, Options{Limits: Limits{MaxSteps: 1000}})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	require.True(t, errors.As(err, &rerr), "expected a runtime error, got %v", err)
+	assert.Equal(t, Address("global decl"), rerr.Address)
+}
+
+func TestStoryEvalStackError(t *testing.T) {
+	c := Container{
+		Contents: []Node{
+			BeginEval{},
+			Add,
+			EndEval{},
+			Done{},
+		},
+	}
+	story := mustNewStory(t, c, nil)
+	_, err := story.Continue()
+	assert.ErrorContains(t, err, "eval stack is empty")
+}
+
+func TestStorySeqError(t *testing.T) {
+	cases := []struct {
+		name            string
+		count, elements IntValue
+		err             string
+	}{
+		{"no elements", 3, 0, "shuffle sequence has 0 elements"},
+		{"negative count", -1, 2, "shuffle sequence count is negative: -1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Container{
+				Contents: []Node{
+					BeginEval{},
+					tc.count,
+					tc.elements,
+					Seq{},
+					EndEval{},
+					Done{},
+				},
+			}
+			story := mustNewStory(t, c, nil)
+			_, err := story.Continue()
+			var rerr *RuntimeError
+			require.True(t, errors.As(err, &rerr), "expected a runtime error, got %v", err)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestStoryUnbalancedEvalError(t *testing.T) {
+	// the function starts a tag with an eval block, and returns with it still
+	// open, so the caller's end of eval closes the tag's
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [["ev", {"f()": "f"}, "/ev", "done", null], "done", {"f": ["#", "ev", null]}],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+	_, err = story.Continue()
+	var rerr *RuntimeError
+	require.True(t, errors.As(err, &rerr), "expected a runtime error, got %v", err)
+	assert.Equal(t, EndEval{}, rerr.Node)
+}
+
+func TestStoryEmptyRoot(t *testing.T) {
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [null],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+	assert.False(t, story.CanContinue())
+	assert.Equal(t, "", mustContinue(t, story))
+
+	require.NoError(t, story.SwitchFlow("other"))
+	assert.False(t, story.CanContinue())
+}
+
+func TestStoryChoiceTargetError(t *testing.T) {
+	c := Container{
+		Contents: []Node{
+			ChoicePoint{Dest: "missing", Flags: OnceOnly},
+			Done{},
+		},
+	}
+	story := mustNewStory(t, c, nil)
+	_, err := story.Continue()
+	var rerr *RuntimeError
+	require.True(t, errors.As(err, &rerr), "expected a runtime error, got %v", err)
+	assert.ErrorContains(t, err, `choice target "missing" not found`)
+}
+
+func TestStoryChoosePath(t *testing.T) {
+	container, listDefs := load(t, "./testdata/choose-path.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Start.\n", mustContinue(t, story))
+	assert.False(t, story.CanContinue())
+
+	require.NoError(t, story.ChoosePath("scene", "Monty", StringValue("tense")))
+	assert.Equal(t, "Monty looks tense.\nScene visits: 1, aftermath visits: 1, turns: 1.\n", mustContinue(t, story))
+
+	require.NoError(t, story.ChoosePath("scene.aftermath"))
+	assert.Equal(t, "Scene visits: 1, aftermath visits: 2, turns: 2.\n", mustContinue(t, story))
+}
+
+func TestStoryChoosePathResetsCallstack(t *testing.T) {
+	container, listDefs := load(t, "./testdata/func-text-content.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	// stop partway through the function
+	for story.eval.(StepEvaluator).Stack.prev == nil {
+		_, err := story.step()
+		require.NoError(t, err)
+	}
+	require.NoError(t, story.ChoosePath("0"))
+	stack := story.eval.(StepEvaluator).Stack
+	assert.Nil(t, stack.prev)
+	assert.Equal(t, 0, stack.callDepth)
+}
+
+func TestStoryChoosePathInvalid(t *testing.T) {
+	container, listDefs := load(t, "./testdata/choose-path.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.EqualError(t, story.ChoosePath("missing"), `no content at path "missing"`)
+	assert.EqualError(t, story.ChoosePath("scene", []string{"Monty"}), "argument 0: unsupported value []string")
+	assert.Equal(t, "Start.\n", mustContinue(t, story))
+}
+
+func TestStoryEnd(t *testing.T) {
+	container, listDefs := load(t, "./testdata/end.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Before.\nEnding.\n", mustContinue(t, story))
+	assert.Empty(t, story.CurrentChoices())
+	assert.Equal(t, StatusEnded, story.Status())
+	// the tunnel and thread frames are unwound
+	assert.Nil(t, story.eval.(StepEvaluator).Stack.prev)
+}
+
+func TestStoryStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want Status
+	}{
+		{"sample", StatusWaitingForChoice},
+		{"func-abs", StatusDone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			container, listDefs := load(t, "./testdata/"+tc.name+".ink.json")
+			story := mustNewStory(t, container, listDefs)
+			assert.Equal(t, StatusCanContinue, story.Status())
+			mustContinue(t, story)
+			assert.Equal(t, tc.want, story.Status())
+		})
+	}
+}
+
+func TestStoryThreadDone(t *testing.T) {
+	container, listDefs := load(t, "./testdata/thread-done.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	// DONE in the tunnel finishes the whole thread
+	assert.Equal(t, "Sub.\nMain text.\n", mustContinue(t, story))
+	require.Len(t, story.CurrentChoices(), 1)
+
+	// the choice continues in its own thread, so DONE ends the flow rather than
+	// returning to the thread it was forked from
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Chose A.\n", mustContinue(t, story))
+	assert.Equal(t, StatusDone, story.Status())
+}
+
+func TestStoryThreadAtEnd(t *testing.T) {
+	// a thread with nothing after it, as the last element of the story, ends
+	// the story once the thread is done
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": ["^Hello", "\n", "thread", null],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Hello\n", mustContinue(t, story))
+	assert.False(t, story.CanContinue())
+}
+
+func TestStoryRandomState(t *testing.T) {
+	container, listDefs := load(t, "./testdata/random.ink.json")
+	// continue up to the first random number
+	start := func() *Story {
+		story := mustNewStory(t, container, listDefs)
+		for range 4 {
+			mustContinueLine(t, story)
+		}
+		return story
+	}
+
+	// each story has its own random numbers, so another story seeding and
+	// generating numbers in between doesn't change them
+	story := start()
+	seed, previous := story.RandomState()
+	other := start()
+	rest := mustContinue(t, other)
+	assert.Equal(t, "7\n8\n", rest)
+	assert.Equal(t, rest, mustContinue(t, story))
+
+	// the random state can be restored from the host
+	story = start()
+	story.SetRandomState(1, 0)
+	story.SetRandomState(seed, previous)
+	assert.Equal(t, rest, mustContinue(t, story))
+
+	// and it's saved with the rest of the state
+	story = reload(t, start(), container, listDefs)
+	assert.Equal(t, rest, mustContinue(t, story))
+}
+
+func TestStoryCompatibility(t *testing.T) {
+	container, listDefs := load(t, "./testdata/numbers.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, strings.Join([]string{
+		"2147483648",
+		"-2147483649",
+		"4294967296",
+		"1e+06",
+		"1.6777216e+07",
+		"1e+10",
+		"1e-05",
+		"0.33333334",
+		"x1e+06",
+	}, "\n")+"\n", mustContinue(t, story))
+
+	// the reference runtime has 32-bit ints, and formats floats like C#
+	story = mustNewStory(t, container, listDefs)
+	story.SetCompatibility(true)
+	assert.Equal(t, strings.Join([]string{
+		"-2147483648",
+		"2147483647",
+		"0",
+		"1000000",
+		"16777216",
+		"1E+10",
+		"1E-05",
+		"0.33333334",
+		"x1000000",
+	}, "\n")+"\n", mustContinue(t, story))
+}
+
+func TestStoryCompatibilityFloats(t *testing.T) {
+	// prints 0.1 added ten times, then n
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [
+			["ev", 0.1, 0.1, "+", 0.1, "+", 0.1, "+", 0.1, "+", 0.1, "+", 0.1, "+", 0.1, "+", 0.1, "+", 0.1, "+",
+				"out", "/ev", "\n", "ev", {"VAR?": "n"}, "out", "/ev", "\n", "done", null],
+			"done",
+			{"global decl": ["ev", 0, {"VAR=": "n"}, "/ev", "end", null]}
+		],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+
+	story := mustNewStory(t, container, listDefs)
+	require.NoError(t, story.Variables().Set("n", 1<<32+5))
+	assert.Equal(t, "1\n4294967301\n", mustContinue(t, story))
+
+	// the reference runtime rounds floats to single precision after each
+	// operation, and assigned ints wrap like the story's own
+	story = mustNewStory(t, container, listDefs)
+	story.SetCompatibility(true)
+	require.NoError(t, story.Variables().Set("n", 1<<32+5))
+	assert.Equal(t, "1.0000001\n5\n", mustContinue(t, story))
+}
+
+func TestStoryCompatibilityGlobals(t *testing.T) {
+	// VAR x = 2147483647 + 1
+	// VAR f = 16777217.0
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [
+			["ev", {"VAR?": "x"}, "out", "/ev", "\n", "done", null],
+			"done",
+			{"global decl": ["ev", 2147483647, 1, "+", {"VAR=": "x"}, 16777217.0, {"VAR=": "f"}, "/ev", "end", null]}
+		],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+
+	story := mustNewStory(t, container, listDefs)
+	story.SetCompatibility(true)
+	assert.Equal(t, "2147483648\n", mustContinue(t, story))
+
+	// the global declarations follow the reference runtime too when the story
+	// starts in compatibility mode
+	story, err = NewStoryWithOptions(container, listDefs, Options{Compatibility: true})
+	require.NoError(t, err)
+	f, err := story.Variables().GetFloat("f")
+	require.NoError(t, err)
+	assert.Equal(t, float64(16777216), f)
+	assert.Equal(t, "-2147483648\n", mustContinue(t, story))
+}
+
+func TestStoryWarnings(t *testing.T) {
+	container, listDefs := load(t, "./testdata/warnings.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Start.\n", mustContinue(t, story))
+	assert.Equal(t, []Warning{
+		{Address: "0", Index: 10, Message: "choice has no text"},
+	}, story.Warnings())
+
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Loose end.\n", mustContinue(t, story))
+	assert.Equal(t, []Warning{
+		{Address: "0.c-0", Index: 2, Message: "ran out of content, do you need a '-> DONE' or '-> END'?"},
+	}, story.Warnings())
+
+	// inklecate rejects assignments to undeclared globals, so this story can
+	// only come from hand-written JSON
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [["ev", 2, "/ev", {"VAR=": "score", "re": true}, "done", null], "done", null],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	story = mustNewStory(t, container, listDefs)
+	mustContinue(t, story)
+	assert.Equal(t, []Warning{
+		{Address: "0", Index: 3, Message: `setting undeclared global variable "score"`},
+	}, story.Warnings())
+
+	// a story that finishes with DONE or END has nothing to warn about
+	container, listDefs = load(t, "./testdata/flows.ink.json")
+	story = mustNewStory(t, container, listDefs)
+	mustContinue(t, story)
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	mustContinue(t, story)
+	assert.Empty(t, story.Warnings())
+}
+
+func TestStoryLimits(t *testing.T) {
+	container, listDefs := load(t, "./testdata/limits.ink.json")
+	cases := []struct {
+		name   string
+		path   string
+		limits Limits
+		err    string
+	}{
+		{"steps", "loop", Limits{MaxSteps: 1000}, "limit exceeded: more than 1000 steps"},
+		{"output", "text", Limits{MaxOutput: 100}, "limit exceeded: more than 100 bytes of output"},
+		{"call depth", "deep", Limits{MaxCallDepth: 50}, "limit exceeded: call depth is more than 50"},
+		{"eval stack", "deep", Limits{MaxEvalStack: 50}, "limit exceeded: eval stack has more than 50 values"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			story := mustNewStory(t, container, listDefs)
+			story.SetLimits(tc.limits)
+			assert.Equal(t, "Start.\n", mustContinue(t, story))
+			require.NoError(t, story.ChoosePath(tc.path))
+			_, err := story.Continue()
+			require.ErrorIs(t, err, ErrLimitExceeded)
+			assert.ErrorContains(t, err, tc.err)
+			var rerr *RuntimeError
+			assert.ErrorAs(t, err, &rerr)
+		})
+	}
+
+	// ContinueLine has the same limits, since a loop may never end the line
+	story := mustNewStory(t, container, listDefs)
+	story.SetLimits(Limits{MaxSteps: 1000})
+	require.NoError(t, story.ChoosePath("loop"))
+	_, err := story.ContinueLine()
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+
+	// the global declarations run within the limits too
+	container, listDefs, err = LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [["done", null], "done", {"global decl": [{"->": "global decl"}, null]}],
+		"listDefs": {}
+	}`))
+	require.NoError(t, err)
+	_, err = NewStoryWithOptions(container, listDefs, Options{Limits: Limits{MaxSteps: 1000}})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+}
+
+func TestStoryContinueAsync(t *testing.T) {
+	container, listDefs := load(t, "./testdata/flows.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	var text string
+	var done bool
+	calls := 0
+	for !done {
+		var err error
+		// each call runs at least one step, so the story makes progress even
+		// without any time
+		text, done, err = story.ContinueAsync(0)
+		require.NoError(t, err)
+		calls++
+		if !done {
+			assert.Empty(t, text)
+			assert.ErrorContains(t, story.ChooseChoiceIndex(0), "in the middle of ContinueAsync")
+			assert.ErrorContains(t, story.SwitchFlow("chatter"), "in the middle of ContinueAsync")
+			assert.ErrorContains(t, story.Variables().Set("coins", 5), "in the middle of ContinueAsync")
+		}
+	}
+	assert.Greater(t, calls, 1)
+	assert.Equal(t, "Main story.\n", text)
+	require.Len(t, story.CurrentChoices(), 1)
+
+	// Continue finishes a continuation that stopped early
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	_, done, err := story.ContinueAsync(0)
+	require.NoError(t, err)
+	require.False(t, done)
+	assert.Equal(t, "Paid, coins: 1.\n", mustContinue(t, story))
+}
+
+func TestStoryContinueContext(t *testing.T) {
+	container, listDefs := load(t, "./testdata/limits.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	assert.Equal(t, "Start.\n", mustContinue(t, story))
+	require.NoError(t, story.ChoosePath("loop"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var saved strings.Builder
+	require.NoError(t, story.SaveState(&saved))
+	_, err := story.ContinueContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// the story is rewound rather than left in the middle of the text
+	var after strings.Builder
+	require.NoError(t, story.SaveState(&after))
+	assert.Equal(t, saved.String(), after.String())
+
+	// a context cancelled part way through the text rewinds to its start, so
+	// the next call produces the whole text
+	container, listDefs = load(t, "./testdata/flows.ink.json")
+	story = mustNewStory(t, container, listDefs)
+	saved.Reset()
+	require.NoError(t, story.SaveState(&saved))
+	_, err = story.ContinueContext(&cancelAfter{Context: context.Background(), checks: 3})
+	assert.ErrorIs(t, err, context.Canceled)
+	after.Reset()
+	require.NoError(t, story.SaveState(&after))
+	assert.Equal(t, saved.String(), after.String())
+	text, err := story.ContinueContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Main story.\n", text)
+
+	// a cancelled context stops before running anything
+	story = mustNewStory(t, container, listDefs)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = story.ContinueContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	text, err = story.ContinueContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Main story.\n", text)
+
+	// a cancelled context also rewinds a text that ContinueAsync started
+	story = mustNewStory(t, container, listDefs)
+	saved.Reset()
+	require.NoError(t, story.SaveState(&saved))
+	_, done, err := story.ContinueAsync(0)
+	require.NoError(t, err)
+	require.False(t, done)
+	_, err = story.ContinueContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	after.Reset()
+	require.NoError(t, story.SaveState(&after))
+	assert.Equal(t, saved.String(), after.String())
+	assert.Equal(t, "Main story.\n", mustContinue(t, story))
+}
+
+// cancelAfter is a context which is cancelled once its error has been checked
+// a number of times, to stop ContinueContext after a given number of steps.
+type cancelAfter struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.checks--; c.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestStoryRunOutOfContent(t *testing.T) {
+	container, listDefs := load(t, "./testdata/warnings.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	mustContinue(t, story)
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Loose end.\n", mustContinue(t, story))
+	// only a function returns a value when it runs out of content, so nothing
+	// is left on the eval stack once the story has finished
+	assert.Nil(t, story.eval.(StepEvaluator).Stack.evalStack)
+	var b strings.Builder
+	require.NoError(t, story.SaveState(&b))
+	assert.Contains(t, b.String(), `"evalStack":[]`)
+}
+
+func TestStoryChoiceSeesLaterChanges(t *testing.T) {
+	container, listDefs := load(t, "./testdata/flows.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	mustContinue(t, story)
+	// the choice continues with the variables as they are when it's chosen,
+	// not as they were when it was generated
+	require.NoError(t, story.Variables().Set("coins", 10))
+	require.NoError(t, story.ChooseChoiceIndex(0))
+	assert.Equal(t, "Paid, coins: 11.\n", mustContinue(t, story))
+}
+
+func TestStoryListRandomOrder(t *testing.T) {
+	container, listDefs, err := LoadJSON(strings.NewReader(`{
+		"inkVersion": 21,
+		"root": [[
+			"ev", {"list": {"fruit.cherry": 3}}, {"list": {"fruit.apple": 1}}, "+",
+			"lrnd", "out", "/ev", "\n", "done", null
+		], "done", null],
+		"listDefs": {"fruit": {"apple": 1, "banana": 2, "cherry": 3}}
+	}`))
+	require.NoError(t, err)
+	story := mustNewStory(t, container, listDefs)
+	// the first number from seed 0 is even, so the first item added to the
+	// list is picked, rather than the lowest
+	story.SetRandomState(0, 0)
+	assert.Equal(t, "cherry\n", mustContinue(t, story))
+}
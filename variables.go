@@ -0,0 +1,159 @@
+package gouache
+
+import (
+	"fmt"
+	"iter"
+	"reflect"
+	"slices"
+)
+
+// Variables gives the host access to the global variables of a story.
+type Variables struct {
+	story *Story
+}
+
+// Variables returns the global variables of the story.
+func (s *Story) Variables() Variables {
+	return Variables{story: s}
+}
+
+// Get returns the current value of a global variable, and whether the variable
+// is declared.
+func (v Variables) Get(name string) (Value, bool) {
+	if _, ok := v.story.globals.Get(name); !ok {
+		return nil, false
+	}
+	return v.story.globalVars().Get(name)
+}
+
+// GetInt returns the value of an integer variable.
+func (v Variables) GetInt(name string) (int, error) {
+	i, err := get[IntValue](v, name)
+	return int(i), err
+}
+
+// GetFloat returns the value of a float variable, or of an integer variable as
+// a float.
+func (v Variables) GetFloat(name string) (float64, error) {
+	if i, err := get[IntValue](v, name); err == nil {
+		return float64(i), nil
+	}
+	f, err := get[FloatValue](v, name)
+	return float64(f), err
+}
+
+// GetBool returns the value of a boolean variable.
+func (v Variables) GetBool(name string) (bool, error) {
+	b, err := get[BoolValue](v, name)
+	return bool(b), err
+}
+
+// GetString returns the value of a string variable.
+func (v Variables) GetString(name string) (string, error) {
+	s, err := get[StringValue](v, name)
+	return string(s), err
+}
+
+// GetList returns the value of a list variable.
+func (v Variables) GetList(name string) (ListValue, error) {
+	return get[ListValue](v, name)
+}
+
+func get[T Value](v Variables, name string) (T, error) {
+	var t T
+	val, ok := v.Get(name)
+	if !ok {
+		return t, fmt.Errorf("variable %q is not declared", name)
+	}
+	t, ok = val.(T)
+	if !ok {
+		return t, fmt.Errorf("variable %q is %T, not %T", name, val, t)
+	}
+	return t, nil
+}
+
+// Set assigns a global variable. The value may be a Value, or an int, float,
+// bool or string which is converted to the matching Value. As with the
+// reference runtime, the variable must be declared in the story, and the value
+// must have the same type as the variable's initial value, although an int may
+// be assigned to a float variable.
+func (v Variables) Set(name string, value any) error {
+	if err := v.story.checkNotPending("set a variable"); err != nil {
+		return err
+	}
+	initial, ok := v.story.globals.Get(name)
+	if !ok {
+		return fmt.Errorf("cannot assign to variable %q which isn't declared in the story", name)
+	}
+	val, err := toValue(value)
+	if err != nil {
+		return fmt.Errorf("cannot assign to variable %q: %w", name, err)
+	}
+	if i, ok := val.(IntValue); ok {
+		if _, ok := initial.(FloatValue); ok {
+			val = FloatValue(i)
+		}
+	}
+	if reflect.TypeOf(val) != reflect.TypeOf(initial) {
+		return fmt.Errorf("cannot assign %T to variable %q, which is %T", val, name, initial)
+	}
+	se := v.story.eval.(StepEvaluator)
+	old, _ := se.Stack.globals.Get(name)
+	if u, ok := old.(interface {
+		Updated(Value) Value
+	}); ok {
+		// keep the origins of lists when assigning an empty list
+		val = u.Updated(val)
+	}
+	if se.Stack.compat {
+		val = compatValue(val)
+	}
+	se.Stack = se.Stack.withGlobals(se.Stack.globals.With(name, val))
+	v.story.eval = se
+	v.story.notify([]varChange{{name: name, old: old, new: val}})
+	return nil
+}
+
+// toValue converts Go values to the matching Value.
+func toValue(value any) (Value, error) {
+	switch value := value.(type) {
+	case int:
+		return IntValue(value), nil
+	case int64:
+		return IntValue(value), nil
+	case int32:
+		return IntValue(value), nil
+	case float64:
+		return FloatValue(value), nil
+	case float32:
+		return FloatValue(value), nil
+	case bool:
+		return BoolValue(value), nil
+	case string:
+		return StringValue(value), nil
+	case IntValue, FloatValue, BoolValue, StringValue, ListValue, DivertTargetValue:
+		return value, nil
+	}
+	return nil, fmt.Errorf("unsupported value %T", value)
+}
+
+// All iterates over the names and current values of the global variables, in
+// the order they're declared.
+func (v Variables) All() iter.Seq2[string, Value] {
+	var names []string
+	for vars := v.story.globals; vars != nil; vars = vars.prev {
+		if !slices.Contains(names, vars.name) {
+			names = append(names, vars.name)
+		}
+	}
+	slices.Reverse(names)
+	return func(yield func(string, Value) bool) {
+		globals := v.story.globalVars()
+		for _, name := range names {
+			val, _ := globals.Get(name)
+			if !yield(name, val) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package gouache
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVariablesGet(t *testing.T) {
+	container, listDefs := load(t, "./testdata/variables.ink.json")
+	vars := mustNewStory(t, container, listDefs).Variables()
+
+	v, ok := vars.Get("gold")
+	assert.True(t, ok)
+	assert.Equal(t, IntValue(10), v)
+	_, ok = vars.Get("mana")
+	assert.False(t, ok)
+	// list items are not variables
+	_, ok = vars.Get("red")
+	assert.False(t, ok)
+
+	gold, err := vars.GetInt("gold")
+	require.NoError(t, err)
+	assert.Equal(t, 10, gold)
+	speed, err := vars.GetFloat("speed")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, speed)
+	alive, err := vars.GetBool("alive")
+	require.NoError(t, err)
+	assert.True(t, alive)
+	name, err := vars.GetString("name")
+	require.NoError(t, err)
+	assert.Equal(t, "Monty", name)
+	paint, err := vars.GetList("paint")
+	require.NoError(t, err)
+	assert.Equal(t, ListSingle("colors", "red", 1), paint)
+
+	_, err = vars.GetInt("name")
+	assert.EqualError(t, err, `variable "name" is gouache.StringValue, not gouache.IntValue`)
+	_, err = vars.GetInt("mana")
+	assert.EqualError(t, err, `variable "mana" is not declared`)
+}
+
+func TestVariablesSet(t *testing.T) {
+	container, listDefs := load(t, "./testdata/variables.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	vars := story.Variables()
+	require.NoError(t, vars.Set("gold", 25))
+	// ints can be assigned to floats
+	require.NoError(t, vars.Set("speed", 2))
+	require.NoError(t, vars.Set("alive", false))
+	require.NoError(t, vars.Set("name", StringValue("Bob")))
+	require.NoError(t, vars.Set("paint", ListSingle("colors", "blue", 3)))
+	assert.Equal(t, "Gold 25, speed 2, false, Bob, paint blue.\n", mustContinue(t, story))
+
+	speed, _ := vars.Get("speed")
+	assert.Equal(t, FloatValue(2), speed)
+}
+
+func TestVariablesSetInvalid(t *testing.T) {
+	container, listDefs := load(t, "./testdata/variables.ink.json")
+	vars := mustNewStory(t, container, listDefs).Variables()
+	assert.EqualError(t, vars.Set("mana", 5), `cannot assign to variable "mana" which isn't declared in the story`)
+	assert.EqualError(t, vars.Set("gold", "lots"), `cannot assign gouache.StringValue to variable "gold", which is gouache.IntValue`)
+	assert.EqualError(t, vars.Set("gold", 1.5), `cannot assign gouache.FloatValue to variable "gold", which is gouache.IntValue`)
+	assert.EqualError(t, vars.Set("gold", []int{1}), `cannot assign to variable "gold": unsupported value []int`)
+	gold, err := vars.GetInt("gold")
+	require.NoError(t, err)
+	assert.Equal(t, 10, gold)
+}
+
+func TestVariablesSetEmptyList(t *testing.T) {
+	container, listDefs := load(t, "./testdata/variables.ink.json")
+	vars := mustNewStory(t, container, listDefs).Variables()
+	require.NoError(t, vars.Set("paint", ListValue{}))
+	paint, err := vars.GetList("paint")
+	require.NoError(t, err)
+	assert.Empty(t, paint.Items)
+	assert.Equal(t, map[string]struct{}{"colors": {}}, paint.Origins)
+}
+
+func TestVariablesSetObserved(t *testing.T) {
+	container, listDefs := load(t, "./testdata/variables.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	changes := recordChanges(t, story, "gold")
+	require.NoError(t, story.Variables().Set("gold", 15))
+	assert.Equal(t, []string{"gold: 10 -> 15"}, *changes)
+}
+
+func TestVariablesAll(t *testing.T) {
+	container, listDefs := load(t, "./testdata/variables.ink.json")
+	story := mustNewStory(t, container, listDefs)
+	require.NoError(t, story.Variables().Set("gold", 15))
+	var names []string
+	for name := range story.Variables().All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"colors", "gold", "speed", "alive", "name", "paint"}, names)
+	all := maps.Collect(story.Variables().All())
+	assert.Equal(t, IntValue(15), all["gold"])
+	assert.Equal(t, StringValue("Monty"), all["name"])
+}